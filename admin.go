@@ -0,0 +1,266 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrShutdownDisabled is returned by Shutdown if the server was not started
+// with shutdown enabled (memcached -A).
+var ErrShutdownDisabled = errors.New("memcache: shutdown not enabled")
+
+// errShutdown keeps the connection to a server that was shut down from
+// being returned to the pool.
+var errShutdown = errors.New("memcache: server shut down")
+
+var (
+	resultVersionPrefix = []byte("VERSION ")
+	resultErrorPrefix   = []byte("ERROR")
+)
+
+// Version is the version of a server, e.g. 1.6.21. Versions compare by
+// their major, minor and patch numbers.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+	// Raw is the version as reported by the server, e.g. 1.4.5-beta.
+	Raw string
+}
+
+// versionError is returned for a version reply which is not understood.
+// The reply has been read, the connection is still usable.
+type versionError struct {
+	msg string
+}
+
+func (e *versionError) Error() string {
+	return e.msg
+}
+
+// ParseVersion parses a version like 1.6.21. Missing minor and patch
+// numbers are zero, anything after the numbers is only kept in Raw.
+func ParseVersion(s string) (Version, error) {
+	v := Version{Raw: s}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	rest := s
+	for i, n := range nums {
+		end := 0
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			if i == 0 {
+				return v, &versionError{fmt.Sprintf("memcache: malformed version %q", s)}
+			}
+			break
+		}
+		*n, _ = strconv.Atoi(rest[:end])
+		rest = rest[end:]
+		if !strings.HasPrefix(rest, ".") {
+			break
+		}
+		rest = rest[1:]
+	}
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 if v is older than, the same as or newer
+// than o.
+func (v Version) Compare(o Version) int {
+	a := [3]int{v.Major, v.Minor, v.Patch}
+	b := [3]int{o.Major, o.Minor, o.Patch}
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast reports whether v is major.minor.patch or newer.
+func (v Version) AtLeast(major, minor, patch int) bool {
+	return v.Compare(Version{Major: major, Minor: minor, Patch: patch}) >= 0
+}
+
+func (v Version) String() string {
+	if v.Raw != "" {
+		return v.Raw
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// FlushAllOptions configures FlushAllWithOptions.
+type FlushAllOptions struct {
+	// Delay invalidates the items only after the given number of seconds.
+	Delay int32
+	// NoReply does not wait for the response of the server.
+	NoReply bool
+}
+
+// Version returns the version of the server.
+func (c *Conn) Version() (Version, error) {
+	line, err := c.writeReadLine("version\r\n")
+	if err != nil {
+		return Version{}, err
+	}
+	if !bytes.HasPrefix(line, resultVersionPrefix) {
+		return Version{}, &versionError{fmt.Sprintf("memcache: unexpected response line from version: %q", line)}
+	}
+	return ParseVersion(string(line[len(resultVersionPrefix) : len(line)-2]))
+}
+
+// Verbosity sets the logging level of the server.
+func (c *Conn) Verbosity(level int) error {
+	return c.writeExpectf(resultOk, "verbosity %d\r\n", level)
+}
+
+// CacheMemlimit sets the memory limit of the server in megabytes.
+func (c *Conn) CacheMemlimit(mb int) error {
+	return c.writeExpectf(resultOk, "cache_memlimit %d\r\n", mb)
+}
+
+// FlushAllWithOptions is like FlushAll but may delay the invalidation and
+// skip waiting for the response.
+func (c *Conn) FlushAllWithOptions(opts FlushAllOptions) error {
+	if !opts.NoReply {
+		return c.writeExpectf(resultOk, "flush_all %d\r\n", opts.Delay)
+	}
+	if _, err := fmt.Fprintf(c.rw, "flush_all %d noreply\r\n", opts.Delay); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// Shutdown stops the server. ErrShutdownDisabled is returned if the server
+// does not allow it. The connection is unusable afterwards.
+func (c *Conn) Shutdown() error {
+	line, err := c.writeReadLine("shutdown\r\n")
+	switch {
+	case err == io.EOF:
+		// The server closes the connection when shutting down.
+		return nil
+	case err != nil:
+		return err
+	case bytes.HasPrefix(line, resultErrorPrefix):
+		return ErrShutdownDisabled
+	}
+	return fmt.Errorf("memcache: unexpected response line from shutdown: %q", line)
+}
+
+// Version returns the version of the server addr.
+func (c *Client) Version(ctx context.Context, addr string) (v Version, err error) {
+	err = c.doServer(ctx, addr, func(c conn) error {
+		v, err = c.Version()
+		return err
+	})
+	return
+}
+
+// VersionAll returns the versions of all servers, keyed by server address.
+// If some servers fail, the versions of the others are still returned
+// together with a MultiError.
+func (c *Client) VersionAll(ctx context.Context) (map[string]Version, error) {
+	var mu sync.Mutex
+	vs := make(map[string]Version)
+	err := c.doServers(ctx, c.Servers(), func(addr string, c conn) error {
+		v, err := c.Version()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		vs[addr] = v
+		mu.Unlock()
+		return nil
+	})
+
+	return vs, err
+}
+
+// Verbosity sets the logging level of the server addr.
+func (c *Client) Verbosity(ctx context.Context, addr string, level int) error {
+	return c.doServer(ctx, addr, func(c conn) error {
+		return c.Verbosity(level)
+	})
+}
+
+// VerbosityAll sets the logging level of all servers.
+func (c *Client) VerbosityAll(ctx context.Context, level int) error {
+	return c.doServers(ctx, c.Servers(), func(addr string, c conn) error {
+		return c.Verbosity(level)
+	})
+}
+
+// CacheMemlimit sets the memory limit of the server addr in megabytes.
+func (c *Client) CacheMemlimit(ctx context.Context, addr string, mb int) error {
+	return c.doServer(ctx, addr, func(c conn) error {
+		return c.CacheMemlimit(mb)
+	})
+}
+
+// CacheMemlimitAll sets the memory limit of all servers in megabytes.
+func (c *Client) CacheMemlimitAll(ctx context.Context, mb int) error {
+	return c.doServers(ctx, c.Servers(), func(addr string, c conn) error {
+		return c.CacheMemlimit(mb)
+	})
+}
+
+// FlushServer invalidates all items of the server addr. It takes a pooled
+// connection even if the commands are multiplexed, as a flush without reply
+// would leave the shared connection waiting for a response.
+func (c *Client) FlushServer(ctx context.Context, addr string, opts FlushAllOptions) error {
+	return c.doPooled(ctx, addr, func(c conn) error {
+		return c.FlushAllWithOptions(opts)
+	})
+}
+
+// FlushAll invalidates all items of all servers, see FlushServer.
+func (c *Client) FlushAll(ctx context.Context, opts FlushAllOptions) error {
+	return eachServer(c.Servers(), func(addr string) error {
+		return c.FlushServer(ctx, addr, opts)
+	})
+}
+
+// Shutdown stops the server addr. It takes a pooled connection even if the
+// commands are multiplexed, as the server closes the connection.
+func (c *Client) Shutdown(ctx context.Context, addr string) error {
+	err := c.doPooled(ctx, addr, shutdown)
+	if err == errShutdown {
+		return nil
+	}
+	return err
+}
+
+// ShutdownAll stops all servers.
+func (c *Client) ShutdownAll(ctx context.Context) error {
+	err := eachServer(c.Servers(), func(addr string) error {
+		return c.doPooled(ctx, addr, shutdown)
+	})
+	if me, ok := err.(MultiError); ok {
+		for addr, err := range me {
+			if err == errShutdown {
+				delete(me, addr)
+			}
+		}
+		if len(me) == 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+func shutdown(c conn) error {
+	if err := c.Shutdown(); err != nil {
+		return err
+	}
+	return errShutdown
+}
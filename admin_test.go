@@ -0,0 +1,134 @@
+package memcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestParseVersion(t *testing.T) {
+	cases := []struct {
+		s    string
+		want Version
+	}{
+		{"1.6.21", Version{1, 6, 21, "1.6.21"}},
+		{"1.4", Version{1, 4, 0, "1.4"}},
+		{"1.4.5-beta", Version{1, 4, 5, "1.4.5-beta"}},
+		{"1.5.22.1", Version{1, 5, 22, "1.5.22.1"}},
+	}
+	for _, c := range cases {
+		if v, err := ParseVersion(c.s); err != nil || v != c.want {
+			t.Errorf("ParseVersion(%q) = %+v, %v", c.s, v, err)
+		}
+	}
+	if _, err := ParseVersion("beta"); err == nil {
+		t.Error("ParseVersion of garbage should fail")
+	}
+
+	v, _ := ParseVersion("1.6.21")
+	if !v.AtLeast(1, 6, 0) || !v.AtLeast(1, 6, 21) || v.AtLeast(1, 6, 22) || v.AtLeast(2, 0, 0) {
+		t.Error("AtLeast is wrong")
+	}
+	old, _ := ParseVersion("1.4.39")
+	if v.Compare(old) != 1 || old.Compare(v) != -1 || v.Compare(v) != 0 {
+		t.Error("Compare is wrong")
+	}
+}
+
+func TestConnAdmin(t *testing.T) {
+	c := setup(t)
+
+	if v, err := c.Version(); err != nil || !v.AtLeast(1, 0, 0) {
+		t.Errorf("Version = %v, %v", v, err)
+	}
+	if err := c.Verbosity(0); err != nil {
+		t.Error(err)
+	}
+
+	c.Set(&Item{Key: "foo", Value: []byte("bar")})
+	if err := c.FlushAllWithOptions(FlushAllOptions{NoReply: true}); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Get("foo"); err != ErrCacheMiss {
+		t.Errorf("Get after flush_all noreply: %v", err)
+	}
+	c.Set(&Item{Key: "foo", Value: []byte("bar")})
+	if err := c.FlushAllWithOptions(FlushAllOptions{Delay: 60}); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Get("foo"); err != nil {
+		t.Errorf("Get before delayed flush_all: %v", err)
+	}
+	// Cancel the delayed flush.
+	if err := c.FlushAll(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientAdmin(t *testing.T) {
+	s1, s2 := memcachetest.NewServer(), memcachetest.NewServer()
+	defer s1.Close()
+	defer s2.Close()
+	ctx := context.Background()
+
+	for _, p := range []Protocol{ProtocolText, ProtocolBinary} {
+		c, _ := NewCluster([]string{s1.Addr(), s2.Addr()}, 0, 10, WithProtocol(p))
+
+		vs, err := c.VersionAll(ctx)
+		if err != nil || len(vs) != 2 || vs[s1.Addr()].String() != memcachetest.Version {
+			t.Errorf("protocol %d: VersionAll = %v, %v", p, vs, err)
+		}
+		if v, err := c.Version(ctx, s2.Addr()); err != nil || v.String() != memcachetest.Version {
+			t.Errorf("protocol %d: Version = %v, %v", p, v, err)
+		}
+		if _, err := c.Version(ctx, "127.0.0.1:1"); err != ErrNoServers {
+			t.Errorf("protocol %d: Version of unknown server: %v", p, err)
+		}
+
+		if err := c.VerbosityAll(ctx, 2); err != nil {
+			t.Errorf("protocol %d: VerbosityAll: %v", p, err)
+		}
+		stats, _ := c.Stats(ctx, "settings")
+		if v := stats[s2.Addr()].Settings().Verbosity; v != 2 {
+			t.Errorf("protocol %d: verbosity %d", p, v)
+		}
+
+		c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")})
+		if err := c.FlushAll(ctx, FlushAllOptions{Delay: 10}); err != nil {
+			t.Errorf("protocol %d: FlushAll: %v", p, err)
+		}
+		if _, err := c.Get(ctx, "foo"); err != nil {
+			t.Errorf("protocol %d: Get before delayed flush: %v", p, err)
+		}
+		s1.Advance(10 * time.Second)
+		s2.Advance(10 * time.Second)
+		if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+			t.Errorf("protocol %d: Get after delayed flush: %v", p, err)
+		}
+		c.Close()
+	}
+
+	c, _ := NewCluster([]string{s1.Addr(), s2.Addr()}, 0, 10)
+	defer c.Close()
+	if err := c.CacheMemlimitAll(ctx, 128); err != nil {
+		t.Error(err)
+	}
+	stats, _ := c.Stats(ctx, "settings")
+	if mb := stats[s1.Addr()].Settings().MaxBytes; mb != 128<<20 {
+		t.Errorf("maxbytes %d", mb)
+	}
+
+	if err := c.Shutdown(ctx, s1.Addr()); err != ErrShutdownDisabled {
+		t.Errorf("Shutdown want ErrShutdownDisabled, got %v", err)
+	}
+	s1.EnableShutdown()
+	s2.EnableShutdown()
+	if err := c.ShutdownAll(ctx); err != nil {
+		t.Errorf("ShutdownAll: %v", err)
+	}
+	if _, err := c.VersionAll(ctx); err == nil {
+		t.Error("servers still running after ShutdownAll")
+	}
+}
@@ -0,0 +1,255 @@
+package memcache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MetaBatch queues meta commands which are sent to the server in a single
+// round trip. Every command is sent in quiet mode with its own opaque token
+// and the batch is terminated by a "mn" command, so the server only answers
+// the commands whose result matters and every answer is matched back to its
+// command by the opaque token.
+//
+// The zero value is an empty batch ready to use.
+type MetaBatch struct {
+	cmds []metaBatchCmd
+}
+
+type metaBatchCmd struct {
+	cmd   string
+	key   string
+	flags []metaFlag
+	data  []byte
+	quiet bool
+	// quietErr is the result of a quiet command whose response has been
+	// suppressed by the server.
+	quietErr error
+}
+
+// MetaBatchResult is the result of a command queued in a MetaBatch.
+type MetaBatchResult struct {
+	MetaResult
+	Err error
+}
+
+// Get queues a meta get command. A miss is reported as ErrCacheMiss.
+func (b *MetaBatch) Get(opt MetaGetOptions) {
+	b.add(metaBatchCmd{
+		cmd:      "mg",
+		key:      stringfyKey(opt.Key, opt.BinaryKey),
+		flags:    opt.marshal(),
+		quiet:    true,
+		quietErr: ErrCacheMiss,
+	})
+}
+
+// Set queues a meta set command.
+func (b *MetaBatch) Set(opt MetaSetOptions) {
+	if opt.Value == nil {
+		opt.Value = []byte{}
+	}
+	b.add(metaBatchCmd{
+		cmd:   "ms",
+		key:   stringfyKey(opt.Key, opt.BinaryKey),
+		flags: opt.marshal(),
+		data:  opt.Value,
+		quiet: !opt.GetCasToken,
+	})
+}
+
+// Delete queues a meta delete command. The server does not answer a quiet
+// delete of a missing key, so it is not reported as ErrCacheMiss.
+func (b *MetaBatch) Delete(opt MetaDeletOptions) {
+	b.add(metaBatchCmd{
+		cmd:   "md",
+		key:   stringfyKey(opt.Key, opt.BinaryKey),
+		flags: opt.marshal(),
+		quiet: true,
+	})
+}
+
+// Arithmetic queues a meta arithmetic command. The new value is returned
+// in the Value of the result when GetValue is set. It is not sent in quiet
+// mode, as the server may not answer a quiet arithmetic on a missing key
+// either, so a miss is reported as ErrCacheMiss.
+func (b *MetaBatch) Arithmetic(opt MetaArithmeticOptions) {
+	b.add(metaBatchCmd{
+		cmd:   "ma",
+		key:   stringfyKey(opt.Key, opt.BinaryKey),
+		flags: opt.marshal(),
+	})
+}
+
+// Len returns the number of queued commands.
+func (b *MetaBatch) Len() int {
+	return len(b.cmds)
+}
+
+func (b *MetaBatch) add(cmd metaBatchCmd) {
+	b.cmds = append(b.cmds, cmd)
+}
+
+// MetaBatch sends all commands of b in a single round trip. The results are
+// returned in the order the commands have been queued. The returned error
+// is only set when the batch as a whole failed, the errors of single
+// commands are reported in their results.
+func (c *Conn) MetaBatch(b *MetaBatch) ([]MetaBatchResult, error) {
+	return c.metaBatch(b.cmds)
+}
+
+func (c *Conn) metaBatch(cmds []metaBatchCmd) ([]MetaBatchResult, error) {
+	rs := make([]MetaBatchResult, len(cmds))
+	answered := make([]bool, len(cmds))
+	skip := make([]bool, len(cmds))
+	for i, cmd := range cmds {
+		if !legalKey(cmd.key) {
+			rs[i].Err, answered[i], skip[i] = ErrMalformedKey, true, true
+		}
+	}
+
+	// Write while reading, so a large batch can not dead lock with a
+	// server which blocks on writing responses nobody reads yet.
+	werr := make(chan error, 1)
+	go func() {
+		err := c.writeMetaBatch(cmds, skip)
+		werr <- err
+		if err != nil && c.nc != nil {
+			// The commands left unwritten are never answered, unblock
+			// the reader.
+			c.nc.SetReadDeadline(time.Now())
+		}
+	}()
+	rerr := c.readMetaBatch(rs, answered)
+	select {
+	case err := <-werr:
+		// A write error comes first, the read failed because of it.
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if rerr != nil && c.nc != nil {
+			// The server may have stopped reading, unblock the writer.
+			c.nc.SetWriteDeadline(time.Now())
+		}
+		if err := <-werr; err != nil && rerr == nil {
+			return nil, err
+		}
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	for i, cmd := range cmds {
+		if !answered[i] {
+			rs[i].Err = cmd.quietErr
+		}
+	}
+	return rs, nil
+}
+
+func (c *Conn) writeMetaBatch(cmds []metaBatchCmd, skip []bool) error {
+	for i, cmd := range cmds {
+		if skip[i] {
+			continue
+		}
+		flags := make([]metaFlag, 0, len(cmd.flags)+2)
+		flags = append(flags, cmd.flags...)
+		flags = append(flags, withOpaque(strconv.Itoa(i)))
+		if cmd.quiet {
+			flags = append(flags, withQuiet())
+		}
+		if err := c.writeMetaCmd(cmd.cmd, cmd.key, flags, cmd.data); err != nil {
+			return err
+		}
+	}
+	if _, err := c.rw.WriteString("mn\r\n"); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *Conn) readMetaBatch(rs []MetaBatchResult, answered []bool) error {
+	for {
+		mr, err := parseMetaResponse(c.rw.Reader, c.pooled)
+		if mr.isNoOp {
+			return nil
+		}
+		if !IsResumableErr(err) {
+			return err
+		}
+		i, perr := strconv.Atoi(mr.Opaque)
+		if perr != nil || i < 0 || i >= len(rs) || answered[i] {
+			return fmt.Errorf("memcache: unexpected opaque in batch response: %q", mr.Opaque)
+		}
+		rs[i], answered[i] = MetaBatchResult{MetaResult: mr, Err: err}, true
+	}
+}
+
+// MetaBatch sends the commands of b to their servers, one round trip per
+// server, with all servers queried concurrently. The results are returned
+// in the order the commands have been queued. If some servers fail, the
+// results of their commands carry the server error and a MultiError is
+// returned as well. Servers without the meta commands fail with
+// ErrNotSupported.
+func (c *Client) MetaBatch(ctx context.Context, b *MetaBatch) ([]MetaBatchResult, error) {
+	if c.opts.Protocol != ProtocolText {
+		return nil, ErrNotSupported
+	}
+
+	idxByServer := make(map[string][]int)
+	for i, cmd := range b.cmds {
+		addr, err := c.selector.PickServer(cmd.key)
+		if err != nil {
+			return nil, err
+		}
+		idxByServer[addr] = append(idxByServer[addr], i)
+	}
+
+	addrs := make([]string, 0, len(idxByServer))
+	for addr := range idxByServer {
+		addrs = append(addrs, addr)
+	}
+
+	// A batch is read while it is written, so it takes a connection of its
+	// own instead of waiting for its turn on a multiplexed one.
+	rs := make([]MetaBatchResult, len(b.cmds))
+	err := eachServer(addrs, func(addr string) error {
+		return c.doPooled(ctx, addr, func(cn conn) error {
+			return c.metaBatchServer(addr, cn, b, idxByServer[addr], rs)
+		})
+	})
+	if errs, ok := err.(MultiError); ok {
+		for addr, err := range errs {
+			for _, j := range idxByServer[addr] {
+				rs[j].Err = err
+			}
+		}
+	}
+
+	return rs, err
+}
+
+// metaBatchServer sends the commands idx of b to the server addr over cn
+// and stores their results in rs.
+func (c *Client) metaBatchServer(addr string, cn conn, b *MetaBatch, idx []int, rs []MetaBatchResult) error {
+	if caps, err := c.probe(addr, cn); err != nil {
+		return err
+	} else if !caps.Meta {
+		return ErrNotSupported
+	}
+	cmds := make([]metaBatchCmd, len(idx))
+	for i, j := range idx {
+		cmds[i] = b.cmds[j]
+	}
+	srs, err := cn.(*Conn).metaBatch(cmds)
+	if err != nil {
+		return err
+	}
+	for i, j := range idx {
+		rs[j] = srs[i]
+	}
+	return nil
+}
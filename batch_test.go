@@ -0,0 +1,188 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMetaBatch(t *testing.T) {
+	c, _ := New(os.Getenv("MC_ADDRESS"), 2, 100)
+	ctx := context.Background()
+
+	b := new(MetaBatch)
+	for i := 0; i < 100; i++ {
+		k := "BATCH_" + strconv.Itoa(i)
+		b.Set(MetaSetOptions{Key: k, Value: []byte(k), SetTTL: 60})
+	}
+	b.Delete(MetaDeletOptions{Key: "BATCH_MISSING"})
+	b.Set(MetaSetOptions{Key: "BATCH_CAS", Value: []byte("cas"), GetCasToken: true})
+	b.Set(MetaSetOptions{Key: "BATCH_0", Value: []byte("added"), Mode: MetaSetModeAdd})
+	b.Set(MetaSetOptions{Key: "BATCH BAD"})
+	rs, err := c.MetaBatch(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != b.Len() {
+		t.Fatalf("got %d results, want %d", len(rs), b.Len())
+	}
+	for i := 0; i < 101; i++ {
+		if rs[i].Err != nil {
+			t.Errorf("result %d: %v", i, rs[i].Err)
+		}
+	}
+	if rs[101].Err != nil || rs[101].CasToken.value == 0 {
+		t.Errorf("set with cas: %v %v", rs[101].Err, rs[101].CasToken)
+	}
+	if rs[102].Err != ErrNotStored {
+		t.Errorf("add existing key: want ErrNotStored, got %v", rs[102].Err)
+	}
+	if rs[103].Err != ErrMalformedKey {
+		t.Errorf("malformed key: want ErrMalformedKey, got %v", rs[103].Err)
+	}
+
+	b = new(MetaBatch)
+	for i := 0; i < 100; i++ {
+		b.Get(MetaGetOptions{Key: "BATCH_" + strconv.Itoa(i), GetValue: true})
+	}
+	b.Get(MetaGetOptions{Key: "BATCH_MISSING", GetValue: true})
+	b.Arithmetic(MetaArithmeticOptions{Key: "BATCH_NUM", SetVivifyWithTTL: 60, InitialValue: 7, GetValue: true})
+	rs, err = c.MetaBatch(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if want := []byte("BATCH_" + strconv.Itoa(i)); rs[i].Err != nil || !bytes.Equal(rs[i].Value, want) {
+			t.Errorf("get %d: got %q, %v, want %q", i, rs[i].Value, rs[i].Err, want)
+		}
+	}
+	if rs[100].Err != ErrCacheMiss {
+		t.Errorf("get missing key: want ErrCacheMiss, got %v", rs[100].Err)
+	}
+	if rs[101].Err != nil || string(rs[101].Value) != "7" {
+		t.Errorf("arithmetic: got %q, %v", rs[101].Value, rs[101].Err)
+	}
+}
+
+func TestConnMetaBatch(t *testing.T) {
+	c := setup(t)
+
+	b := new(MetaBatch)
+	b.Set(MetaSetOptions{Key: "CONN_BATCH", Value: []byte("v")})
+	b.Get(MetaGetOptions{Key: "CONN_BATCH", GetValue: true})
+	b.Arithmetic(MetaArithmeticOptions{Key: "CONN_BATCH_MISSING"})
+	rs, err := c.MetaBatch(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs[0].Err != nil || rs[1].Err != nil || string(rs[1].Value) != "v" {
+		t.Errorf("got %+v", rs)
+	}
+	if rs[2].Err != ErrCacheMiss {
+		t.Errorf("arithmetic of a missing key: %v", rs[2].Err)
+	}
+	if err := c.ping(); err != nil {
+		t.Errorf("connection not reusable after batch: %v", err)
+	}
+}
+
+// failWriteConn is a connection whose writes fail.
+type failWriteConn struct{ net.Conn }
+
+func (failWriteConn) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestConnMetaBatchWriteError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		// Receive nothing and answer nothing.
+		<-stop
+	}()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c := NewConn(failWriteConn{nc})
+
+	b := new(MetaBatch)
+	b.Get(MetaGetOptions{Key: "foo", GetValue: true})
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.MetaBatch(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "write failed" {
+			t.Errorf("MetaBatch of a failing connection = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MetaBatch blocked reading after a write error")
+	}
+}
+
+func TestConnMetaBatchReadError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		// Answer garbage and stop reading.
+		nc.Write([]byte("garbage\r\n"))
+		<-stop
+	}()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c := NewConn(nc)
+
+	// The batch is larger than the socket buffers, the writer blocks.
+	b := new(MetaBatch)
+	value := make([]byte, 1<<20)
+	for i := 0; i < 32; i++ {
+		b.Set(MetaSetOptions{Key: "BATCH_" + strconv.Itoa(i), Value: value})
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.MetaBatch(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("MetaBatch of a garbage response succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MetaBatch blocked writing after a read error")
+	}
+}
@@ -0,0 +1,618 @@
+package memcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	binaryReqMagic   = 0x80
+	binaryResMagic   = 0x81
+	binaryHeaderSize = 24
+)
+
+// binary protocol opcodes
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opFlush     = 0x08
+	opFlushQ    = 0x18
+	opVerbosity = 0x1b
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetKQ     = 0x0d
+	opStat      = 0x10
+	opTouch     = 0x1c
+	opAppend    = 0x0e
+	opPrepend   = 0x0f
+	opGAT       = 0x1d
+	opGATKQ     = 0x24
+	opSASLList  = 0x20
+	opSASLAuth  = 0x21
+	opSASLStep  = 0x22
+)
+
+// binary protocol response status
+const (
+	statusOK         = 0x00
+	statusNotFound   = 0x01
+	statusExists     = 0x02
+	statusNotStored  = 0x05
+	statusNonNumeric = 0x06
+	statusAuthError  = 0x20
+	statusAuthCont   = 0x21
+)
+
+var (
+	// ErrAuthFailed means that the server rejected the SASL credentials.
+	ErrAuthFailed = errors.New("memcache: authentication failed")
+
+	errNonNumeric = errors.New("memcache: client error: cannot increment or decrement non-numeric value")
+)
+
+// BinaryConn is a memcache connection speaking the binary protocol.
+// It supports the same commands as Conn except the meta commands.
+// It is not safe for concurrent use by multiple goroutines.
+type BinaryConn struct {
+	rw     *bufio.ReadWriter
+	opaque uint32
+	// mux is set if c is a command over a multiplexed connection.
+	mux *muxRequest
+}
+
+// NewBinaryConn create a new memcache connection using the binary protocol.
+func NewBinaryConn(c net.Conn) *BinaryConn {
+	return newBinaryConnSize(c, defaultBufferSize, defaultBufferSize)
+}
+
+func newBinaryConnSize(c net.Conn, readSize, writeSize int) *BinaryConn {
+	rw := bufio.NewReadWriter(newReader(c, readSize), newWriter(c, writeSize))
+
+	return &BinaryConn{rw: rw}
+}
+
+// release recycles the buffers of c after its connection has been closed.
+func (c *BinaryConn) release() {
+	releaseReadWriter(c.rw)
+}
+
+// flush sends the buffered request to the server.
+func (c *BinaryConn) flush() error {
+	if c.mux != nil {
+		return c.mux.send()
+	}
+	return c.rw.Flush()
+}
+
+type binaryRequest struct {
+	opcode byte
+	key    string
+	extras []byte
+	value  []byte
+	cas    uint64
+}
+
+type binaryResponse struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// err converts the status of res into the errors returned by Conn.
+func (res *binaryResponse) err() error {
+	switch res.status {
+	case statusOK:
+		return nil
+	case statusNotFound:
+		return ErrCacheMiss
+	case statusExists:
+		return ErrCASConflict
+	case statusNotStored:
+		return ErrNotStored
+	case statusNonNumeric:
+		return errNonNumeric
+	case statusAuthError:
+		return ErrAuthFailed
+	}
+	return fmt.Errorf("memcache: unexpected status %#x in binary response: %q", res.status, res.value)
+}
+
+// writeRequest buffers req and returns its opaque value.
+func (c *BinaryConn) writeRequest(req *binaryRequest) (uint32, error) {
+	opaque, err := c.writeRequestHeader(req, len(req.value))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.rw.Write(req.value); err != nil {
+		return 0, err
+	}
+	return opaque, nil
+}
+
+// writeRequestHeader buffers req up to its value, which is valueLen bytes
+// long and left to the caller, and returns its opaque value.
+func (c *BinaryConn) writeRequestHeader(req *binaryRequest, valueLen int) (uint32, error) {
+	c.opaque++
+
+	var h [binaryHeaderSize]byte
+	h[0] = binaryReqMagic
+	h[1] = req.opcode
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(req.key)))
+	h[4] = byte(len(req.extras))
+	binary.BigEndian.PutUint32(h[8:12], uint32(len(req.extras)+len(req.key)+valueLen))
+	binary.BigEndian.PutUint32(h[12:16], c.opaque)
+	binary.BigEndian.PutUint64(h[16:24], req.cas)
+
+	if _, err := c.rw.Write(h[:]); err != nil {
+		return 0, err
+	}
+	if _, err := c.rw.Write(req.extras); err != nil {
+		return 0, err
+	}
+	if _, err := c.rw.WriteString(req.key); err != nil {
+		return 0, err
+	}
+	return c.opaque, nil
+}
+
+func (c *BinaryConn) readResponse() (*binaryResponse, error) {
+	res, valueLen, err := c.readResponseHeader()
+	if err != nil {
+		return nil, err
+	}
+	res.value = make([]byte, valueLen)
+	if _, err := io.ReadFull(c.rw, res.value); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readResponseHeader reads a response up to its value and returns the
+// length of the value, which is left to the caller.
+func (c *BinaryConn) readResponseHeader() (*binaryResponse, int, error) {
+	var h [binaryHeaderSize]byte
+	if _, err := io.ReadFull(c.rw, h[:]); err != nil {
+		return nil, 0, err
+	}
+	if h[0] != binaryResMagic {
+		return nil, 0, fmt.Errorf("memcache: unexpected magic %#x in binary response", h[0])
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(h[2:4]))
+	extLen := int(h[4])
+	bodyLen := int(binary.BigEndian.Uint32(h[8:12]))
+	if extLen+keyLen > bodyLen {
+		return nil, 0, fmt.Errorf("memcache: corrupt binary response header")
+	}
+	head := make([]byte, extLen+keyLen)
+	if _, err := io.ReadFull(c.rw, head); err != nil {
+		return nil, 0, err
+	}
+
+	return &binaryResponse{
+		opcode: h[1],
+		status: binary.BigEndian.Uint16(h[6:8]),
+		opaque: binary.BigEndian.Uint32(h[12:16]),
+		cas:    binary.BigEndian.Uint64(h[16:24]),
+		extras: head[:extLen],
+		key:    head[extLen:],
+	}, bodyLen - extLen - keyLen, nil
+}
+
+// roundTrip sends req and reads its response. Only errors which leave the
+// connection in an unknown state are returned, the status of the response
+// is left to the caller.
+func (c *BinaryConn) roundTrip(req *binaryRequest) (*binaryResponse, error) {
+	switch req.opcode {
+	case opNoop, opVersion, opFlush, opVerbosity, opSASLList:
+		// The commands without key.
+	default:
+		if !legalKey(req.key) {
+			return nil, ErrMalformedKey
+		}
+	}
+	opaque, err := c.writeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	res, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if res.opaque != opaque || res.opcode != req.opcode {
+		return nil, fmt.Errorf("memcache: binary response out of order")
+	}
+	return res, nil
+}
+
+func (res *binaryResponse) item(key string) (*Item, error) {
+	if err := res.err(); err != nil {
+		return nil, err
+	}
+	if len(res.extras) < 4 {
+		return nil, fmt.Errorf("memcache: corrupt get result read")
+	}
+	return &Item{
+		Key:   key,
+		Value: res.value,
+		Flags: binary.BigEndian.Uint32(res.extras),
+		CAS:   res.cas,
+	}, nil
+}
+
+// Get gets the item for the given key. ErrCacheMiss is returned for a
+// memcache cache miss. The key must be at most 250 bytes in length.
+func (c *BinaryConn) Get(key string) (*Item, error) {
+	res, err := c.roundTrip(&binaryRequest{opcode: opGet, key: key})
+	if err != nil {
+		return nil, err
+	}
+	return res.item(key)
+}
+
+// GetAndTouch gets the item for the given key and updates its expiry.
+// ErrCacheMiss is returned for a memcache cache miss.
+func (c *BinaryConn) GetAndTouch(key string, seconds int32) (*Item, error) {
+	res, err := c.roundTrip(&binaryRequest{opcode: opGAT, key: key, extras: uint32Extras(uint32(seconds))})
+	if err != nil {
+		return nil, err
+	}
+	return res.item(key)
+}
+
+// GetMulti is a batch version of Get. The returned map from keys to
+// items may have fewer elements than the input slice, due to memcache
+// cache misses. The keys are pipelined with quiet gets terminated by a noop.
+func (c *BinaryConn) GetMulti(keys []string) (map[string]*Item, error) {
+	return c.getMulti(opGetKQ, nil, keys)
+}
+
+// GetAndTouchMulti is a batch version of GetAndTouch. The returned map
+// from keys to items may have fewer elements than the input slice, due to
+// memcache cache misses.
+func (c *BinaryConn) GetAndTouchMulti(keys []string, seconds int32) (map[string]*Item, error) {
+	return c.getMulti(opGATKQ, uint32Extras(uint32(seconds)), keys)
+}
+
+// getMulti pipelines the quiet get command op of every key, terminated by
+// a noop.
+func (c *BinaryConn) getMulti(op byte, extras []byte, keys []string) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, ErrMalformedKey
+		}
+	}
+	for _, key := range keys {
+		if _, err := c.writeRequest(&binaryRequest{opcode: op, key: key, extras: extras}); err != nil {
+			return nil, err
+		}
+	}
+	opaque, err := c.writeRequest(&binaryRequest{opcode: opNoop})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*Item, len(keys))
+	for {
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if res.opcode == opNoop {
+			if res.opaque != opaque {
+				return nil, fmt.Errorf("memcache: binary response out of order")
+			}
+			return items, nil
+		}
+		if res.opcode != op || res.status != statusOK {
+			return nil, fmt.Errorf("memcache: unexpected binary response %#x/%#x in get", res.opcode, res.status)
+		}
+		it, err := res.item(string(res.key))
+		if err != nil {
+			return nil, err
+		}
+		items[it.Key] = it
+	}
+}
+
+// Set writes the given item, unconditionally.
+func (c *BinaryConn) Set(item *Item) error {
+	return c.store(opSet, item, 0)
+}
+
+// Add writes the given item, if no value already exists for its
+// key. ErrNotStored is returned if that condition is not met.
+func (c *BinaryConn) Add(item *Item) error {
+	return c.store(opAdd, item, 0)
+}
+
+// Replace writes the given item, but only if the server *does*
+// already hold data for this key
+func (c *BinaryConn) Replace(item *Item) error {
+	return c.store(opReplace, item, 0)
+}
+
+// Append adds the value of the given item after the value already held
+// for its key. The flags and expiration of the item are ignored.
+// ErrNotStored is returned if the server holds no data for the key.
+func (c *BinaryConn) Append(item *Item) error {
+	return c.store(opAppend, item, 0)
+}
+
+// Prepend adds the value of the given item before the value already held
+// for its key. The flags and expiration of the item are ignored.
+// ErrNotStored is returned if the server holds no data for the key.
+func (c *BinaryConn) Prepend(item *Item) error {
+	return c.store(opPrepend, item, 0)
+}
+
+// CompareAndSwap writes the given item that was previously returned
+// by Get, if the value was neither modified or evicted between the
+// Get and the CompareAndSwap calls. ErrCASConflict is returned if the
+// value was modified in between the calls, or if item has no CAS, like
+// the text protocol does. ErrCacheMiss is returned if the value was
+// evicted in between the calls.
+func (c *BinaryConn) CompareAndSwap(item *Item) error {
+	// A set without CAS would be unconditional.
+	if item.CAS == 0 {
+		return ErrCASConflict
+	}
+	return c.store(opSet, item, item.CAS)
+}
+
+func (c *BinaryConn) store(op byte, item *Item, cas uint64) error {
+	// Append and prepend keep the flags and expiration of the item and
+	// must not have extras.
+	var extras []byte
+	if op != opAppend && op != opPrepend {
+		extras = make([]byte, 8)
+		binary.BigEndian.PutUint32(extras[0:4], item.Flags)
+		binary.BigEndian.PutUint32(extras[4:8], uint32(item.Expiration))
+	}
+
+	res, err := c.roundTrip(&binaryRequest{
+		opcode: op,
+		key:    item.Key,
+		extras: extras,
+		value:  item.Value,
+		cas:    cas,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The binary protocol reports a failed add as an existing key and a
+	// failed replace as a missing key, Conn reports both as not stored.
+	switch {
+	case op == opAdd && res.status == statusExists,
+		op == opReplace && res.status == statusNotFound:
+		return ErrNotStored
+	}
+	return res.err()
+}
+
+// Delete deletes the item with the provided key. The error ErrCacheMiss is
+// returned if the item didn't already exist in the cache.
+func (c *BinaryConn) Delete(key string) error {
+	res, err := c.roundTrip(&binaryRequest{opcode: opDelete, key: key})
+	if err != nil {
+		return err
+	}
+	return res.err()
+}
+
+// Increment atomically increments key by delta. The return value is
+// the new value after being incremented or an error. If the value
+// didn't exist in memcached the error is ErrCacheMiss.
+func (c *BinaryConn) Increment(key string, delta uint64) (uint64, error) {
+	return c.incrDecr(opIncrement, key, delta)
+}
+
+// Decrement atomically decrements key by delta. The return value is
+// the new value after being decremented or an error. If the value
+// didn't exist in memcached the error is ErrCacheMiss.
+func (c *BinaryConn) Decrement(key string, delta uint64) (uint64, error) {
+	return c.incrDecr(opDecrement, key, delta)
+}
+
+func (c *BinaryConn) incrDecr(op byte, key string, delta uint64) (uint64, error) {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], delta)
+	// An expiration of all ones makes the server fail on a missing key
+	// instead of creating it with the initial value.
+	binary.BigEndian.PutUint32(extras[16:20], 0xffffffff)
+
+	res, err := c.roundTrip(&binaryRequest{opcode: op, key: key, extras: extras})
+	if err != nil {
+		return 0, err
+	}
+	if err := res.err(); err != nil {
+		return 0, err
+	}
+	if len(res.value) != 8 {
+		return 0, fmt.Errorf("memcache: corrupt %#x result read", op)
+	}
+	return binary.BigEndian.Uint64(res.value), nil
+}
+
+// Touch updates the expiry for the given key. ErrCacheMiss is returned if
+// the key is not in the cache.
+func (c *BinaryConn) Touch(key string, seconds int32) error {
+	res, err := c.roundTrip(&binaryRequest{opcode: opTouch, key: key, extras: uint32Extras(uint32(seconds))})
+	if err != nil {
+		return err
+	}
+	return res.err()
+}
+
+// FlushAll clear all item
+func (c *BinaryConn) FlushAll() error {
+	res, err := c.roundTrip(&binaryRequest{opcode: opFlush})
+	if err != nil {
+		return err
+	}
+	return res.err()
+}
+
+// Noop sends a no-op command and waits for its response.
+func (c *BinaryConn) Noop() error {
+	res, err := c.roundTrip(&binaryRequest{opcode: opNoop})
+	if err != nil {
+		return err
+	}
+	return res.err()
+}
+
+// Version returns the version of the server.
+func (c *BinaryConn) Version() (Version, error) {
+	res, err := c.roundTrip(&binaryRequest{opcode: opVersion})
+	if err != nil {
+		return Version{}, err
+	}
+	if err := res.err(); err != nil {
+		return Version{}, err
+	}
+	return ParseVersion(string(res.value))
+}
+
+// Verbosity sets the logging level of the server.
+func (c *BinaryConn) Verbosity(level int) error {
+	res, err := c.roundTrip(&binaryRequest{opcode: opVerbosity, extras: uint32Extras(uint32(level))})
+	if err != nil {
+		return err
+	}
+	return res.err()
+}
+
+// CacheMemlimit is not supported by the binary protocol.
+func (c *BinaryConn) CacheMemlimit(mb int) error {
+	return ErrNotSupported
+}
+
+// FlushAllWithOptions is like FlushAll but may delay the invalidation and
+// skip waiting for the response.
+func (c *BinaryConn) FlushAllWithOptions(opts FlushAllOptions) error {
+	req := &binaryRequest{opcode: opFlush, extras: uint32Extras(uint32(opts.Delay))}
+	if !opts.NoReply {
+		res, err := c.roundTrip(req)
+		if err != nil {
+			return err
+		}
+		return res.err()
+	}
+	req.opcode = opFlushQ
+	if _, err := c.writeRequest(req); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// Shutdown is not supported by the binary protocol.
+func (c *BinaryConn) Shutdown() error {
+	return ErrNotSupported
+}
+
+// Stats returns the statistics selected by args, e.g. "settings", "slabs",
+// "items" or "conns", or the general statistics without args. The args are
+// joined by spaces into the key of the request, e.g. "detail dump", which
+// is not checked like the key of an item.
+func (c *BinaryConn) Stats(args ...string) (Stats, error) {
+	group := strings.Join(args, " ")
+	opaque, err := c.writeRequest(&binaryRequest{opcode: opStat, key: group})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	stats := make(Stats)
+	for {
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if res.opaque != opaque || res.opcode != opStat {
+			return nil, fmt.Errorf("memcache: binary response out of order")
+		}
+		if res.status == statusNotFound {
+			return nil, fmt.Errorf("memcache: unknown stats %q", group)
+		}
+		if err := res.err(); err != nil {
+			return nil, err
+		}
+		if len(res.key) == 0 {
+			return stats, nil
+		}
+		stats[string(res.key)] = string(res.value)
+	}
+}
+
+func uint32Extras(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// Auth authenticates the connection with SASL PLAIN. ErrAuthFailed is
+// returned if the server rejects the credentials.
+func (c *BinaryConn) Auth(username, password string) error {
+	res, err := c.roundTrip(&binaryRequest{opcode: opSASLList})
+	if err != nil {
+		return err
+	}
+	if err := res.err(); err != nil {
+		return err
+	}
+	if !hasMech(string(res.value), "PLAIN") {
+		return fmt.Errorf("memcache: SASL PLAIN not supported by server, got mechanisms %q", res.value)
+	}
+
+	// authzid NUL authcid NUL passwd, see RFC 4616.
+	msg := []byte("\x00" + username + "\x00" + password)
+	op := byte(opSASLAuth)
+	for {
+		res, err := c.roundTrip(&binaryRequest{opcode: op, key: "PLAIN", value: msg})
+		if err != nil {
+			return err
+		}
+		if res.status != statusAuthCont {
+			return res.err()
+		}
+		// PLAIN has no challenge, a server asking to continue gets the
+		// credentials once more in a step request.
+		if op == opSASLStep {
+			return ErrAuthFailed
+		}
+		op = opSASLStep
+	}
+}
+
+func hasMech(mechs, mech string) bool {
+	for _, m := range strings.Fields(mechs) {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package memcache
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+)
+
+func setupBinary(t *testing.T) *BinaryConn {
+	addr := os.Getenv("MC_ADDRESS")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	return NewBinaryConn(conn)
+}
+
+func TestBinaryConn(t *testing.T) {
+	c := setupBinary(t)
+	testWithClient(t, c)
+}
+
+func TestBinaryConnCommands(t *testing.T) {
+	c := setupBinary(t)
+
+	if err := c.Noop(); err != nil {
+		t.Error(err)
+	}
+	if v, err := c.Version(); err != nil || !v.AtLeast(1, 0, 0) {
+		t.Errorf("Version = %v, %v", v, err)
+	}
+	if s, err := c.Stats(); err != nil || s["version"] == "" {
+		t.Errorf("Stats = %v, %v", s, err)
+	}
+
+	foo := &Item{Key: "foo", Value: []byte("fooval"), Flags: 7}
+	if err := c.Set(foo); err != nil {
+		t.Fatal(err)
+	}
+	it, err := c.GetAndTouch("foo", 100)
+	if err != nil || string(it.Value) != "fooval" || it.Flags != 7 {
+		t.Fatalf("GetAndTouch = %+v, %v", it, err)
+	}
+
+	// CAS
+	it.Value = []byte("casval")
+	if err := c.CompareAndSwap(it); err != nil {
+		t.Fatalf("CompareAndSwap: %v", err)
+	}
+	if err := c.CompareAndSwap(it); err != ErrCASConflict {
+		t.Fatalf("second CompareAndSwap want ErrCASConflict, got %v", err)
+	}
+	c.Delete("foo")
+	if err := c.CompareAndSwap(it); err != ErrCacheMiss {
+		t.Fatalf("CompareAndSwap after delete want ErrCacheMiss, got %v", err)
+	}
+	if _, err := c.GetAndTouch("foo", 100); err != ErrCacheMiss {
+		t.Fatalf("GetAndTouch after delete want ErrCacheMiss, got %v", err)
+	}
+}
+
+func TestClientBinary(t *testing.T) {
+	c, _ := New(os.Getenv("MC_ADDRESS"), 2, 100, WithProtocol(ProtocolBinary))
+	ctx := context.Background()
+
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.Get(ctx, "foo")
+	if err != nil || string(item.Value) != "bar" {
+		t.Fatalf("Get = %+v, %v", item, err)
+	}
+	if _, err := c.MetaGet(ctx, MetaGetOptions{Key: "foo"}); err != ErrNotSupported {
+		t.Errorf("MetaGet want ErrNotSupported, got %v", err)
+	}
+}
+
+func TestClientSASL(t *testing.T) {
+	addr := os.Getenv("MC_SASL_ADDRESS")
+	user, pass := os.Getenv("MC_SASL_USERNAME"), os.Getenv("MC_SASL_PASSWORD")
+	ctx := context.Background()
+
+	if _, err := New(addr, 0, 10, WithSASL(user, pass)); err == nil {
+		t.Error("SASL with the text protocol should fail")
+	}
+
+	c, _ := New(addr, 0, 10, WithProtocol(ProtocolBinary), WithSASL(user, pass))
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := c.Get(ctx, "foo"); err != nil || string(item.Value) != "bar" {
+		t.Fatalf("Get = %+v, %v", item, err)
+	}
+
+	c, _ = New(addr, 0, 10, WithProtocol(ProtocolBinary), WithSASL(user, pass+"x"))
+	if _, err := c.Get(ctx, "foo"); err != ErrAuthFailed {
+		t.Errorf("Get with wrong password want ErrAuthFailed, got %v", err)
+	}
+
+	c, _ = New(addr, 0, 10, WithProtocol(ProtocolBinary))
+	if _, err := c.Get(ctx, "foo"); err != ErrAuthFailed {
+		t.Errorf("Get without credentials want ErrAuthFailed, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package memcache
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// The bufio readers and writers of the connections a Client closes are
+// recycled for its new connections. Only buffers of the default size are
+// kept, as they are the common case.
+var (
+	readerPool sync.Pool
+	writerPool sync.Pool
+)
+
+func newReader(rd io.Reader, size int) *bufio.Reader {
+	if size == defaultBufferSize {
+		if r, ok := readerPool.Get().(*bufio.Reader); ok {
+			r.Reset(rd)
+			return r
+		}
+	}
+	return bufio.NewReaderSize(rd, size)
+}
+
+func newWriter(w io.Writer, size int) *bufio.Writer {
+	if size == defaultBufferSize {
+		if bw, ok := writerPool.Get().(*bufio.Writer); ok {
+			bw.Reset(w)
+			return bw
+		}
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+// releaseReadWriter recycles the buffers of rw, which must not be used
+// afterwards.
+func releaseReadWriter(rw *bufio.ReadWriter) {
+	if rw.Reader.Size() == defaultBufferSize {
+		rw.Reader.Reset(nil)
+		readerPool.Put(rw.Reader)
+	}
+	if rw.Writer.Size() == defaultBufferSize {
+		rw.Writer.Reset(nil)
+		writerPool.Put(rw.Writer)
+	}
+}
+
+// Values are read into buffers of power of two sizes from 64 bytes to 1
+// MB, one pool per size. Larger values are allocated as they are.
+const (
+	minValueShift = 6
+	maxValueShift = 20
+)
+
+var valuePools [maxValueShift - minValueShift + 1]sync.Pool
+
+// valueShift returns the size class of a buffer of n bytes, or -1 if n is
+// too large to be pooled.
+func valueShift(n int) int {
+	s := minValueShift
+	if n > 1<<minValueShift {
+		s = bits.Len(uint(n - 1))
+	}
+	if s > maxValueShift {
+		return -1
+	}
+	return s
+}
+
+// newValue returns a buffer of n bytes. If pooled it is taken from the
+// value pool, otherwise it is allocated.
+func newValue(n int, pooled bool) []byte {
+	if !pooled {
+		return make([]byte, n)
+	}
+	s := valueShift(n)
+	if s < 0 {
+		return make([]byte, n)
+	}
+	if b, ok := valuePools[s-minValueShift].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, 1<<uint(s))
+}
+
+// releaseValue returns b, a buffer of newValue, to the value pool.
+// Buffers too large for it are dropped.
+func releaseValue(b []byte) {
+	c := cap(b)
+	s := valueShift(c)
+	if s < 0 || c != 1<<uint(s) {
+		return
+	}
+	b = b[:0]
+	valuePools[s-minValueShift].Put(&b)
+}
+
+// Release returns the value of it to the value pool of the clients created
+// with Options.ValuePool, for the next values read. The value must not be
+// used afterwards and is set to nil. Values the client did not read into
+// the pool, such as the ones set by the caller, are left to the garbage
+// collector.
+func (it *Item) Release() {
+	if it.pooled {
+		releaseValue(it.Value)
+	}
+	it.Value, it.pooled = nil, false
+}
+
+// Release returns the value of mr to the value pool, see Item.Release.
+func (mr *MetaResult) Release() {
+	if mr.pooled {
+		releaseValue(mr.Value)
+	}
+	mr.Value, mr.pooled = nil, false
+}
@@ -0,0 +1,103 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestNewValue(t *testing.T) {
+	cases := []struct{ n, cap int }{
+		{0, 64}, {1, 64}, {64, 64}, {65, 128}, {1000, 1024}, {1 << 20, 1 << 20}, {1<<20 + 1, 1<<20 + 1},
+	}
+	for _, c := range cases {
+		b := newValue(c.n, true)
+		if len(b) != c.n || cap(b) != c.cap {
+			t.Errorf("newValue(%d) has len %d cap %d, want cap %d", c.n, len(b), cap(b), c.cap)
+		}
+		releaseValue(b)
+	}
+	if b := newValue(100, false); len(b) != 100 || cap(b) != 100 {
+		t.Errorf("newValue not pooled has len %d cap %d", len(b), cap(b))
+	}
+
+	it := &Item{Value: make([]byte, 3, 100)}
+	it.Release()
+	if it.Value != nil {
+		t.Error("Release did not clear the value")
+	}
+
+	// A buffer of the caller is never pooled, whatever its size.
+	own := make([]byte, 1<<12)
+	it = &Item{Value: own}
+	it.Release()
+	if b := newValue(1<<12, true); &b[0] == &own[0] {
+		t.Error("Release pooled a value which was not read into the pool")
+	}
+}
+
+func TestClientValuePool(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10, WithValuePool())
+	defer c.Close()
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := "pooled" + strconv.Itoa(i)
+		keys = append(keys, key)
+		c.Set(ctx, &Item{Key: key, Value: bytes.Repeat([]byte{byte('a' + i)}, 50*i)})
+	}
+	for round := 0; round < 3; round++ {
+		for i, key := range keys {
+			it, err := c.Get(ctx, key)
+			if err != nil || !bytes.Equal(it.Value, bytes.Repeat([]byte{byte('a' + i)}, 50*i)) {
+				t.Fatalf("Get(%s) = %q, %v", key, it.Value, err)
+			}
+			it.Release()
+		}
+		m, err := c.GetMulti(ctx, keys)
+		if err != nil || len(m) != len(keys) {
+			t.Fatalf("GetMulti = %v, %v", m, err)
+		}
+		for i, key := range keys {
+			if !bytes.Equal(m[key].Value, bytes.Repeat([]byte{byte('a' + i)}, 50*i)) {
+				t.Errorf("GetMulti(%s) = %q", key, m[key].Value)
+			}
+		}
+		for _, it := range m {
+			it.Release()
+		}
+		mr, err := c.MetaGet(ctx, MetaGetOptions{Key: keys[9], GetValue: true})
+		if err != nil || len(mr.Value) != 450 {
+			t.Fatalf("MetaGet = %+v, %v", mr, err)
+		}
+		mr.Release()
+	}
+}
+
+func BenchmarkConnGetLargeValue(b *testing.B) {
+	value := bytes.Repeat([]byte("x"), 4000)
+	resp := append([]byte("VALUE foo 0 4000\r\n"), value...)
+	resp = append(resp, "\r\nEND\r\n"...)
+
+	for _, pooled := range []bool{false, true} {
+		b.Run("pooled="+strconv.FormatBool(pooled), func(b *testing.B) {
+			c := NewConn(&replayConn{resp: resp})
+			c.pooled = pooled
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it, err := c.Get("foo")
+				if err != nil {
+					b.Fatal(err)
+				}
+				it.Release()
+			}
+		})
+	}
+}
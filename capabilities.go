@@ -0,0 +1,123 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+)
+
+// Capabilities are the features of a server, derived from its version.
+type Capabilities struct {
+	Version Version
+	// Meta is whether the server has the meta commands mg, ms, md and ma.
+	Meta bool
+	// MetaNoop is whether the server has the meta no-op command mn.
+	MetaNoop bool
+	// Base64Keys is whether meta commands take base64 encoded binary keys.
+	Base64Keys bool
+	// TLS is whether the server can be built with TLS support.
+	TLS bool
+	// GetAndTouch is whether the server has the gat and gats commands.
+	GetAndTouch bool
+}
+
+// CapabilitiesOf returns the capabilities of a server of version v.
+func CapabilitiesOf(v Version) Capabilities {
+	return Capabilities{
+		Version:     v,
+		Meta:        v.AtLeast(1, 6, 0),
+		MetaNoop:    v.AtLeast(1, 6, 0),
+		Base64Keys:  v.AtLeast(1, 6, 0),
+		TLS:         v.AtLeast(1, 5, 13),
+		GetAndTouch: v.AtLeast(1, 5, 3),
+	}
+}
+
+// Capabilities returns the capabilities of the server addr. The version of
+// every server is only asked once and cached by the client.
+func (c *Client) Capabilities(ctx context.Context, addr string) (caps Capabilities, err error) {
+	c.capsMu.Lock()
+	caps, ok := c.caps[addr]
+	c.capsMu.Unlock()
+	if ok {
+		return caps, nil
+	}
+
+	err = c.doServer(ctx, addr, func(cn conn) error {
+		caps, err = c.probe(addr, cn)
+		return err
+	})
+	return
+}
+
+// probe returns the cached capabilities of the server addr, asking its
+// version over cn if they are not known yet.
+func (c *Client) probe(addr string, cn conn) (Capabilities, error) {
+	c.capsMu.Lock()
+	caps, ok := c.caps[addr]
+	c.capsMu.Unlock()
+	if ok {
+		return caps, nil
+	}
+
+	v, err := cn.Version()
+	switch err.(type) {
+	case nil:
+		caps = CapabilitiesOf(v)
+	case *versionError:
+		// The version is not understood, e.g. that of a proxy. Whether the
+		// meta commands are there is told by the meta no-op command.
+		caps = Capabilities{Version: v}
+		if tc, ok := cn.(*Conn); ok {
+			meta, err := tc.hasMeta()
+			if err != nil {
+				return caps, err
+			}
+			caps.Meta, caps.MetaNoop, caps.Base64Keys = meta, meta, meta
+		}
+	default:
+		return caps, err
+	}
+
+	c.capsMu.Lock()
+	c.caps[addr] = caps
+	c.capsMu.Unlock()
+	return caps, nil
+}
+
+// hasMeta reports whether the server knows the meta commands, which the
+// servers without answer with ERROR.
+func (c *Conn) hasMeta() (bool, error) {
+	line, err := c.writeReadLine("mn\r\n")
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(line, resultMetaNoop), nil
+}
+
+// doMeta runs fn, a meta command on key, if the server of key has the meta
+// commands. Otherwise fallback runs if the client is configured to fall
+// back and fallback is not nil, or ErrNotSupported is returned.
+func (c *Client) doMeta(ctx context.Context, key string, binaryKey bool, fn, fallback func(c *Conn) error) error {
+	if c.opts.Protocol != ProtocolText {
+		return ErrNotSupported
+	}
+
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+
+	return c.doServer(ctx, addr, func(cn conn) error {
+		caps, err := c.probe(addr, cn)
+		if err != nil {
+			return err
+		}
+		switch {
+		case caps.Meta && (!binaryKey || caps.Base64Keys):
+			return fn(cn.(*Conn))
+		case c.opts.MetaFallback && fallback != nil:
+			return fallback(cn.(*Conn))
+		}
+		return ErrNotSupported
+	})
+}
@@ -0,0 +1,168 @@
+package memcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestCapabilitiesOf(t *testing.T) {
+	cases := []struct {
+		v    string
+		want Capabilities
+	}{
+		{"1.4.39", Capabilities{}},
+		{"1.5.3", Capabilities{GetAndTouch: true}},
+		{"1.5.22", Capabilities{GetAndTouch: true, TLS: true}},
+		{"1.6.21", Capabilities{Meta: true, MetaNoop: true, Base64Keys: true, TLS: true, GetAndTouch: true}},
+	}
+	for _, c := range cases {
+		v, _ := ParseVersion(c.v)
+		c.want.Version = v
+		if caps := CapabilitiesOf(v); caps != c.want {
+			t.Errorf("CapabilitiesOf(%s) = %+v, want %+v", c.v, caps, c.want)
+		}
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+	caps, err := c.Capabilities(ctx, s.Addr())
+	if err != nil || !caps.Meta || caps.Version.String() != memcachetest.Version {
+		t.Fatalf("Capabilities = %+v, %v", caps, err)
+	}
+
+	// The capabilities are cached, a changed server version is not seen.
+	s.SetVersion("1.4.39")
+	if caps, _ := c.Capabilities(ctx, s.Addr()); !caps.Meta {
+		t.Errorf("Capabilities not cached: %+v", caps)
+	}
+	if _, err := c.Capabilities(ctx, "127.0.0.1:1"); err != ErrNoServers {
+		t.Errorf("Capabilities of unknown server: %v", err)
+	}
+}
+
+func TestClientCapabilitiesUnknownVersion(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	s.SetVersion("proxy")
+	ctx := context.Background()
+
+	// A version which is not understood does not fail the commands, the
+	// meta commands are found missing by the meta no-op command.
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.MetaGet(ctx, MetaGetOptions{Key: "foo"}); err != ErrNotSupported {
+			t.Errorf("MetaGet = %v", err)
+		}
+	}
+	caps, err := c.Capabilities(ctx, s.Addr())
+	if err != nil || caps.Meta || caps.Version.Raw != "proxy" {
+		t.Errorf("Capabilities = %+v, %v", caps, err)
+	}
+	// Nor does it break the connection.
+	if _, err := c.Version(ctx, s.Addr()); err == nil {
+		t.Error("Version of a proxy succeeded")
+	}
+	if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Get after Version = %v", err)
+	}
+	if n := s.Stat("total_connections"); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+
+	// Classic commands in a pipeline do not need the capabilities.
+	c2, _ := New(s.Addr(), 0, 10)
+	defer c2.Close()
+	p := c2.Pipeline(ctx)
+	if err := p.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c2.caps) != 0 {
+		t.Errorf("capabilities probed by a classic pipeline: %v", c2.caps)
+	}
+}
+
+func TestMetaFallback(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	s.SetVersion("1.5.22")
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	if _, err := c.MetaGet(ctx, MetaGetOptions{Key: "foo"}); err != ErrNotSupported {
+		t.Errorf("MetaGet without fallback: %v", err)
+	}
+	if _, err := c.MetaBatch(ctx, &MetaBatch{}); err != nil {
+		t.Errorf("empty MetaBatch: %v", err)
+	}
+	b := &MetaBatch{}
+	b.Get(MetaGetOptions{Key: "foo"})
+	if _, err := c.MetaBatch(ctx, b); err == nil {
+		t.Error("MetaBatch without meta commands should fail")
+	}
+	c.Close()
+
+	c, _ = New(s.Addr(), 0, 10, WithMetaFallback())
+	defer c.Close()
+
+	if _, err := c.MetaSet(ctx, MetaSetOptions{Key: "foo", Value: []byte("bar"), SetFlag: 7, SetTTL: 60}); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := c.MetaGet(ctx, MetaGetOptions{Key: "foo", GetValue: true, GetFlags: true, GetSize: true, GetCasToken: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(mr.Value) != "bar" || mr.Flags != 7 || mr.Size != 3 || mr.CasToken.Value() == 0 {
+		t.Errorf("MetaGet = %+v", mr)
+	}
+
+	// A stale token makes the compare and swap fail.
+	_, err = c.MetaSet(ctx, MetaSetOptions{Key: "foo", Value: []byte("baz"), CasToken: NewCasToken(mr.CasToken.Value() + 1)})
+	if err != ErrCASConflict {
+		t.Errorf("MetaSet with stale CAS: %v", err)
+	}
+	if _, err := c.MetaSet(ctx, MetaSetOptions{Key: "foo", Value: []byte("baz"), CasToken: mr.CasToken}); err != nil {
+		t.Errorf("MetaSet with CAS: %v", err)
+	}
+	if _, err := c.MetaSet(ctx, MetaSetOptions{Key: "foo", Value: []byte("!"), Mode: MetaSetModeAppend}); err != nil {
+		t.Errorf("MetaSet append: %v", err)
+	}
+	if _, err := c.MetaSet(ctx, MetaSetOptions{Key: "foo", Value: []byte("x"), Mode: MetaSetModeAdd}); err != ErrNotStored {
+		t.Errorf("MetaSet add of existing key: %v", err)
+	}
+
+	// Get and touch.
+	mr, err = c.MetaGet(ctx, MetaGetOptions{Key: "foo", GetValue: true, SetTTL: 1000})
+	if err != nil || string(mr.Value) != "baz!" {
+		t.Errorf("MetaGet with TTL = %+v, %v", mr, err)
+	}
+	s.Advance(100 * time.Second)
+	if _, err := c.MetaGet(ctx, MetaGetOptions{Key: "foo", SetTTL: 1000}); err != nil {
+		t.Errorf("MetaGet touch: %v", err)
+	}
+
+	if _, err := c.MetaGet(ctx, MetaGetOptions{Key: "missing", GetValue: true}); err != ErrCacheMiss {
+		t.Errorf("MetaGet of missing key: %v", err)
+	}
+	if _, err := c.MetaGet(ctx, MetaGetOptions{Key: "foo", GetTTL: true}); err != ErrNotSupported {
+		t.Errorf("MetaGet with TTL flag: %v", err)
+	}
+	if _, err := c.MetaGet(ctx, MetaGetOptions{BinaryKey: []byte("foo")}); err != ErrNotSupported {
+		t.Errorf("MetaGet with binary key: %v", err)
+	}
+	if _, err := c.MetaDelete(ctx, MetaDeletOptions{Key: "foo"}); err != ErrNotSupported {
+		t.Errorf("MetaDelete: %v", err)
+	}
+}
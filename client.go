@@ -2,7 +2,12 @@ package memcache
 
 import (
 	"context"
+	"io"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kiss/net/pool"
@@ -10,93 +15,361 @@ import (
 
 // Client memcache client
 type Client struct {
-	addr string
-	pool pool.Pooler
+	selector ServerSelector
+	pools    map[string]pool.Pooler
+	muxes    map[string]*muxPool
+	opts     Options
+
+	capsMu sync.Mutex
+	caps   map[string]Capabilities
+
+	// loads deduplicates the loader calls of GetOrLoad.
+	loads flightGroup
+
+	// closing is set by Close, whose connections may still be in use and
+	// must not have their buffers recycled.
+	closing int32
+}
+
+// conn is implemented by the connections of every protocol.
+type conn interface {
+	Get(key string) (*Item, error)
+	GetMulti(keys []string) (map[string]*Item, error)
+	GetAndTouch(key string, seconds int32) (*Item, error)
+	GetAndTouchMulti(keys []string, seconds int32) (map[string]*Item, error)
+	GetTo(key string, w io.Writer) (*Item, error)
+	Set(item *Item) error
+	SetFrom(key string, r io.Reader, size int64, flags uint32, expiration int32) error
+	Add(item *Item) error
+	Replace(item *Item) error
+	Append(item *Item) error
+	Prepend(item *Item) error
+	CompareAndSwap(item *Item) error
+	Delete(key string) error
+	Increment(key string, delta uint64) (uint64, error)
+	Decrement(key string, delta uint64) (uint64, error)
+	Touch(key string, seconds int32) error
+	FlushAll() error
+	FlushAllWithOptions(opts FlushAllOptions) error
+	Stats(args ...string) (Stats, error)
+	Version() (Version, error)
+	Verbosity(level int) error
+	CacheMemlimit(mb int) error
+	Shutdown() error
+
+	release()
 }
 
+var (
+	_ conn = (*Conn)(nil)
+	_ conn = (*BinaryConn)(nil)
+)
+
 // New init client
-func New(addr string, initialCap int, maxCap int) (*Client, error) {
+func New(addr string, initialCap int, maxCap int, opts ...Option) (*Client, error) {
+	return NewCluster([]string{addr}, initialCap, maxCap, opts...)
+}
+
+// NewCluster init client which shards keys over addrs with a
+// ketama-compatible consistent hash
+func NewCluster(addrs []string, initialCap int, maxCap int, opts ...Option) (*Client, error) {
+	return NewWithSelector(NewKetamaSelector(addrs), initialCap, maxCap, opts...)
+}
+
+// NewWithSelector init client which shards keys with ss. Every server
+// returned by ss.Servers gets its own connection pool.
+func NewWithSelector(ss ServerSelector, initialCap int, maxCap int, opts ...Option) (*Client, error) {
+	o := Options{
+		Selector:     ss,
+		PoolSize:     maxCap,
+		MinIdleConns: initialCap,
+		IdleTimeout:  time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return NewWithOptions(o)
+}
+
+// NewWithOptions init client configured by o. It returns an error if o is
+// invalid.
+func NewWithOptions(o Options) (*Client, error) {
+	if err := o.init(); err != nil {
+		return nil, err
+	}
+
+	addrs := o.Selector.Servers()
+	c := &Client{selector: o.Selector, pools: make(map[string]pool.Pooler, len(addrs)), opts: o,
+		caps: make(map[string]Capabilities, len(addrs))}
+	for _, addr := range addrs {
+		c.pools[addr] = newPool(addr, c.opts, &c.closing)
+	}
+	if o.Multiplex > 0 {
+		c.muxes = make(map[string]*muxPool, len(addrs))
+		for _, addr := range addrs {
+			c.muxes[addr] = newMuxPool(addr, &c.opts)
+		}
+	}
+
+	return c, nil
+}
+
+func newPool(addr string, o Options, closing *int32) pool.Pooler {
 	opts := pool.Options{
 		Dialer: func(ctx context.Context) (pool.Closer, error) {
-			var d net.Dialer
-			nc, err := d.DialContext(ctx, "tcp", addr)
+			nc, c, err := dialConn(ctx, addr, o)
 			if err != nil {
 				return nil, err
 			}
+			return &pooledConn{nc: nc, c: c, closing: closing}, nil
+		},
+		PoolSize:           o.PoolSize,
+		MinIdleConns:       o.MinIdleConns,
+		PoolTimeout:        o.PoolTimeout,
+		IdleTimeout:        o.IdleTimeout,
+		MaxConnAge:         o.MaxConnAge,
+		IdleCheckFrequency: o.IdleCheckFrequency,
+	}
 
-			c := NewConn(nc)
+	return pool.New(opts)
+}
 
-			return &pooledConn{nc: nc, c: c}, nil
-		},
-		PoolSize:     maxCap,
-		MinIdleConns: initialCap,
-		IdleTimeout:  time.Minute,
+// dialConn connects to addr and returns the connection of the protocol
+// configured by o, authenticated if o has credentials.
+func dialConn(ctx context.Context, addr string, o Options) (net.Conn, conn, error) {
+	if o.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.DialTimeout)
+		defer cancel()
+	}
+
+	nc, err := dial(ctx, addr, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if o.Protocol == ProtocolBinary {
+		bc := newBinaryConnSize(nc, o.ReadBufferSize, o.WriteBufferSize)
+		if o.Username != "" {
+			if err := auth(ctx, nc, bc, o.Username, o.Password); err != nil {
+				nc.Close()
+				return nil, nil, err
+			}
+		}
+		return nc, bc, nil
+	}
+
+	tc := newConnSize(nc, o.ReadBufferSize, o.WriteBufferSize)
+	tc.pooled = o.ValuePool
+	return nc, tc, nil
+}
+
+func auth(ctx context.Context, nc net.Conn, c *BinaryConn, username, password string) error {
+	if d, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(d)
+		defer nc.SetDeadline(time.Time{})
 	}
 
-	return &Client{pool: pool.New(opts)}, nil
+	return c.Auth(username, password)
 }
 
 type pooledConn struct {
-	nc net.Conn
-	c  *Conn
+	nc      net.Conn
+	c       conn
+	closing *int32
 }
 
 func (pc *pooledConn) Close() error {
-	return pc.nc.Close()
+	err := pc.nc.Close()
+	// The pool only closes connections nobody uses, unless the client is
+	// closed.
+	if atomic.LoadInt32(pc.closing) == 0 {
+		pc.c.release()
+	}
+	return err
 }
 
-// PoolStats 返回连接池状态
+// PoolStats 返回连接池状态，多个服务器时为各连接池之和
 func (c *Client) PoolStats() *pool.Stats {
-	return c.pool.Stats()
+	stats := &pool.Stats{}
+	for _, p := range c.pools {
+		s := p.Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Timeouts += s.Timeouts
+		stats.TotalConns += s.TotalConns
+		stats.IdleConns += s.IdleConns
+		stats.StaleConns += s.StaleConns
+	}
+	return stats
 }
 
-func (c *Client) do(ctx context.Context, fn func(c *Conn) error) error {
-	mc, err := c.pool.Get(ctx)
+// Servers returns the addresses of all configured servers
+func (c *Client) Servers() []string {
+	return c.selector.Servers()
+}
+
+func (c *Client) do(ctx context.Context, key string, fn func(c conn) error) error {
+	addr, err := c.selector.PickServer(key)
 	if err != nil {
 		return err
 	}
 
-	pc := mc.C.(*pooledConn)
+	return c.doServer(ctx, addr, fn)
+}
 
-	if d, ok := ctx.Deadline(); ok {
-		pc.nc.SetDeadline(d)
-	} else {
-		pc.nc.SetDeadline(time.Time{})
+func (c *Client) doServer(ctx context.Context, addr string, fn func(c conn) error) error {
+	if m, ok := c.muxes[addr]; ok {
+		return m.do(ctx, fn)
 	}
 
+	return c.doPooled(ctx, addr, fn)
+}
+
+// doPooled runs fn on a connection to addr taken from the pool, even if the
+// commands are multiplexed. It is used by the commands which read while
+// writing, e.g. MetaBatch and SetFrom, as they cannot wait for their turn
+// on a shared connection before writing everything, by GetTo, which would
+// hold the turn while the caller consumes the value, and by the ones which
+// may get no response, e.g. FlushServer and Shutdown.
+func (c *Client) doPooled(ctx context.Context, addr string, fn func(c conn) error) error {
+	p, ok := c.pools[addr]
+	if !ok {
+		return ErrNoServers
+	}
+
+	mc, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	pc := mc.C.(*pooledConn)
+
+	c.setDeadline(ctx, pc.nc)
+
 	err = fn(pc.c)
-	defer c.put(mc, err)
+	defer put(p, mc, err)
 
 	return err
 }
 
-func (c *Client) put(pc *pool.Conn, err error) {
+// setDeadline bounds the next command on nc by the ctx deadline, or by the
+// configured read and write timeouts if ctx has none.
+func (c *Client) setDeadline(ctx context.Context, nc net.Conn) {
+	if d, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(d)
+		return
+	}
+
+	var rd, wd time.Time
+	now := time.Now()
+	if c.opts.ReadTimeout > 0 {
+		rd = now.Add(c.opts.ReadTimeout)
+	}
+	if c.opts.WriteTimeout > 0 {
+		wd = now.Add(c.opts.WriteTimeout)
+	}
+	nc.SetReadDeadline(rd)
+	nc.SetWriteDeadline(wd)
+}
+
+// doServers runs fn on every server of addrs concurrently. The errors of the
+// failed servers are collected into a MultiError.
+func (c *Client) doServers(ctx context.Context, addrs []string, fn func(addr string, c conn) error) error {
+	return eachServer(addrs, func(addr string) error {
+		return c.doServer(ctx, addr, func(c conn) error {
+			return fn(addr, c)
+		})
+	})
+}
+
+// eachServer runs fn for every server of addrs concurrently. The errors of
+// the failed servers are collected into a MultiError.
+func eachServer(addrs []string, fn func(addr string) error) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(MultiError)
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := fn(addr); err != nil {
+				mu.Lock()
+				errs[addr] = err
+				mu.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// MultiError is returned by commands that run on several servers. It maps
+// the address of every failed server to its error.
+type MultiError map[string]error
+
+func (m MultiError) Error() string {
+	addrs := make([]string, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	msgs := make([]string, 0, len(m))
+	for _, addr := range addrs {
+		msgs = append(msgs, addr+": "+m[addr].Error())
+	}
+	return "memcache: " + strings.Join(msgs, "; ")
+}
+
+func put(p pool.Pooler, pc *pool.Conn, err error) {
 	if IsResumableErr(err) {
-		c.pool.Put(pc)
+		p.Put(pc)
 		return
 	}
 
-	// TODO 复用 bufio 对象
-	c.pool.Remove(pc)
+	// The buffers of the connection are recycled when the pool closes it.
+	p.Remove(pc)
 }
 
 // Add only set new key
 func (c *Client) Add(ctx context.Context, item *Item) error {
-	return c.do(ctx, func(c *Conn) error {
+	return c.do(ctx, item.Key, func(c conn) error {
 		return c.Add(item)
 	})
 }
 
+// Append appends the value of item to the value held for its key.
+// ErrNotStored is returned if the key does not exist.
+func (c *Client) Append(ctx context.Context, item *Item) error {
+	return c.do(ctx, item.Key, func(c conn) error {
+		return c.Append(item)
+	})
+}
+
+// Prepend prepends the value of item to the value held for its key.
+// ErrNotStored is returned if the key does not exist.
+func (c *Client) Prepend(ctx context.Context, item *Item) error {
+	return c.do(ctx, item.Key, func(c conn) error {
+		return c.Prepend(item)
+	})
+}
+
 // CompareAndSwap cas set
 func (c *Client) CompareAndSwap(ctx context.Context, item *Item) error {
-	return c.do(ctx, func(c *Conn) error {
+	return c.do(ctx, item.Key, func(c conn) error {
 		return c.CompareAndSwap(item)
 	})
 }
 
 // Decrement decr key
 func (c *Client) Decrement(ctx context.Context, key string, delta uint64) (d uint64, err error) {
-	err = c.do(ctx, func(c *Conn) error {
+	err = c.do(ctx, key, func(c conn) error {
 		d, err = c.Decrement(key, delta)
 		return err
 	})
@@ -106,14 +379,14 @@ func (c *Client) Decrement(ctx context.Context, key string, delta uint64) (d uin
 
 // Delete delete key
 func (c *Client) Delete(ctx context.Context, key string) error {
-	return c.do(ctx, func(c *Conn) error {
+	return c.do(ctx, key, func(c conn) error {
 		return c.Delete(key)
 	})
 }
 
 // Get get one key
 func (c *Client) Get(ctx context.Context, key string) (i *Item, err error) {
-	err = c.do(ctx, func(c *Conn) error {
+	err = c.do(ctx, key, func(c conn) error {
 		i, err = c.Get(key)
 		return err
 	})
@@ -121,19 +394,78 @@ func (c *Client) Get(ctx context.Context, key string) (i *Item, err error) {
 	return
 }
 
-// GetMulti get multi keys
-func (c *Client) GetMulti(ctx context.Context, keys []string) (is map[string]*Item, err error) {
-	err = c.do(ctx, func(c *Conn) error {
-		is, err = c.GetMulti(keys)
+// GetMulti get multi keys. Keys are grouped by server and every server is
+// queried concurrently. If some servers fail, the items returned by the
+// others are still returned together with a MultiError.
+func (c *Client) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	return c.getMulti(ctx, keys, func(c conn, keys []string) (map[string]*Item, error) {
+		return c.GetMulti(keys)
+	})
+}
+
+// GetAndTouch gets the item for the given key and updates its expiry, e.g.
+// to slide the expiration of a session on every access.
+func (c *Client) GetAndTouch(ctx context.Context, key string, seconds int32) (i *Item, err error) {
+	err = c.do(ctx, key, func(c conn) error {
+		i, err = c.GetAndTouch(key, seconds)
 		return err
 	})
 
 	return
 }
 
+// GetAndTouchMulti is a batch version of GetAndTouch. Like GetMulti, the
+// items of the servers which did not fail are returned together with a
+// MultiError.
+func (c *Client) GetAndTouchMulti(ctx context.Context, keys []string, seconds int32) (map[string]*Item, error) {
+	return c.getMulti(ctx, keys, func(c conn, keys []string) (map[string]*Item, error) {
+		return c.GetAndTouchMulti(keys, seconds)
+	})
+}
+
+// getMulti runs fn with the keys of every server concurrently and merges
+// the returned items.
+func (c *Client) getMulti(ctx context.Context, keys []string, fn func(c conn, keys []string) (map[string]*Item, error)) (map[string]*Item, error) {
+	keysByServer, err := c.groupKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(keysByServer))
+	for addr := range keysByServer {
+		addrs = append(addrs, addr)
+	}
+
+	var mu sync.Mutex
+	is := make(map[string]*Item, len(keys))
+	err = c.doServers(ctx, addrs, func(addr string, c conn) error {
+		m, err := fn(c, keysByServer[addr])
+		mu.Lock()
+		for k, i := range m {
+			is[k] = i
+		}
+		mu.Unlock()
+		return err
+	})
+
+	return is, err
+}
+
+func (c *Client) groupKeys(keys []string) (map[string][]string, error) {
+	keysByServer := make(map[string][]string)
+	for _, key := range keys {
+		addr, err := c.selector.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		keysByServer[addr] = append(keysByServer[addr], key)
+	}
+	return keysByServer, nil
+}
+
 // Increment incr key
 func (c *Client) Increment(ctx context.Context, key string, delta uint64) (d uint64, err error) {
-	err = c.do(ctx, func(c *Conn) error {
+	err = c.do(ctx, key, func(c conn) error {
 		d, err = c.Increment(key, delta)
 		return err
 	})
@@ -143,26 +475,32 @@ func (c *Client) Increment(ctx context.Context, key string, delta uint64) (d uin
 
 // Replace set old key
 func (c *Client) Replace(ctx context.Context, item *Item) error {
-	return c.do(ctx, func(c *Conn) error {
+	return c.do(ctx, item.Key, func(c conn) error {
 		return c.Replace(item)
 	})
 }
 
 // Set set key
 func (c *Client) Set(ctx context.Context, item *Item) error {
-	return c.do(ctx, func(c *Conn) error {
+	return c.do(ctx, item.Key, func(c conn) error {
 		return c.Set(item)
 	})
 }
 
 // Touch change ttl
 func (c *Client) Touch(ctx context.Context, key string, seconds int32) error {
-	return c.do(ctx, func(c *Conn) error {
+	return c.do(ctx, key, func(c conn) error {
 		return c.Touch(key, seconds)
 	})
 }
 
 // Close close all connection
 func (c *Client) Close() {
-	c.pool.Close()
+	atomic.StoreInt32(&c.closing, 1)
+	for _, p := range c.pools {
+		p.Close()
+	}
+	for _, m := range c.muxes {
+		m.Close()
+	}
 }
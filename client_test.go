@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"context"
 	"os"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
 )
 
 func TestClientGet(t *testing.T) {
@@ -34,3 +38,220 @@ func BenchmarkClientGet(b *testing.B) {
 		}
 	}
 }
+
+func TestClientGetAndTouch(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	for _, p := range []Protocol{ProtocolText, ProtocolBinary} {
+		c, _ := New(s.Addr(), 0, 10, WithProtocol(p))
+		c.Set(ctx, &Item{Key: "session", Value: []byte("alice"), Expiration: 60})
+		c.Set(ctx, &Item{Key: "other", Value: []byte("bob"), Expiration: 60})
+
+		// Every access slides the expiration of the session.
+		for i := 0; i < 3; i++ {
+			s.Advance(40 * time.Second)
+			it, err := c.GetAndTouch(ctx, "session", 60)
+			if err != nil || string(it.Value) != "alice" {
+				t.Fatalf("protocol %d: GetAndTouch = %+v, %v", p, it, err)
+			}
+		}
+		if _, err := c.Get(ctx, "other"); err != ErrCacheMiss {
+			t.Errorf("protocol %d: untouched item want ErrCacheMiss, got %v", p, err)
+		}
+
+		c.Set(ctx, &Item{Key: "other", Value: []byte("bob"), Expiration: 60})
+		m, err := c.GetAndTouchMulti(ctx, []string{"session", "other", "missing"}, 120)
+		if err != nil || len(m) != 2 || string(m["other"].Value) != "bob" {
+			t.Fatalf("protocol %d: GetAndTouchMulti = %v, %v", p, m, err)
+		}
+		s.Advance(90 * time.Second)
+		if m, _ := c.GetMulti(ctx, []string{"session", "other"}); len(m) != 2 {
+			t.Errorf("protocol %d: items not touched by GetAndTouchMulti: %v", p, m)
+		}
+
+		// The CAS of the item is returned.
+		it, _ := c.GetAndTouch(ctx, "session", 60)
+		it.Value = []byte("carol")
+		if err := c.CompareAndSwap(ctx, it); err != nil {
+			t.Errorf("protocol %d: CompareAndSwap after GetAndTouch: %v", p, err)
+		}
+
+		// An item without CAS is not stored.
+		if err := c.CompareAndSwap(ctx, &Item{Key: "session", Value: []byte("dave")}); err != ErrCASConflict {
+			t.Errorf("protocol %d: CompareAndSwap without CAS = %v", p, err)
+		}
+		if it, err := c.Get(ctx, "session"); err != nil || string(it.Value) != "carol" {
+			t.Errorf("protocol %d: Get after CompareAndSwap without CAS = %+v, %v", p, it, err)
+		}
+
+		// The binary commands check their keys, empty ones too.
+		if p == ProtocolBinary {
+			if _, err := c.Get(ctx, ""); err != ErrMalformedKey {
+				t.Errorf("protocol %d: Get of an empty key = %v", p, err)
+			}
+			if err := c.Delete(ctx, ""); err != ErrMalformedKey {
+				t.Errorf("protocol %d: Delete of an empty key = %v", p, err)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestClientAppendPrepend(t *testing.T) {
+	for _, p := range []Protocol{ProtocolText, ProtocolBinary} {
+		c, _ := New(os.Getenv("MC_ADDRESS"), 0, 10, WithProtocol(p))
+		ctx := context.Background()
+
+		c.Delete(ctx, "events")
+		if err := c.Append(ctx, &Item{Key: "events", Value: []byte("x")}); err != ErrNotStored {
+			t.Errorf("protocol %d: Append of missing key want ErrNotStored, got %v", p, err)
+		}
+		c.Set(ctx, &Item{Key: "events", Value: []byte("1,")})
+		for _, e := range []string{"2,", "3,"} {
+			if err := c.Append(ctx, &Item{Key: "events", Value: []byte(e)}); err != nil {
+				t.Fatalf("protocol %d: Append: %v", p, err)
+			}
+		}
+		if err := c.Prepend(ctx, &Item{Key: "events", Value: []byte("0,")}); err != nil {
+			t.Fatalf("protocol %d: Prepend: %v", p, err)
+		}
+		if it, err := c.Get(ctx, "events"); err != nil || string(it.Value) != "0,1,2,3," {
+			t.Errorf("protocol %d: Get = %+v, %v", p, it, err)
+		}
+		c.Close()
+	}
+}
+
+func TestClientGetMultiPartial(t *testing.T) {
+	addr, dead := os.Getenv("MC_ADDRESS"), "127.0.0.1:1"
+	c, _ := NewCluster([]string{addr, dead}, 0, 10)
+	single, _ := New(addr, 0, 10)
+
+	var keys, live []string
+	for i := 0; i < 20; i++ {
+		key := "multi" + strconv.Itoa(i)
+		keys = append(keys, key)
+		if s, _ := c.selector.PickServer(key); s == addr {
+			live = append(live, key)
+			single.Set(context.Background(), &Item{Key: key, Value: []byte(key)})
+		}
+	}
+
+	is, err := c.GetMulti(context.Background(), keys)
+	me, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("GetMulti want MultiError, got %v", err)
+	}
+	if _, ok := me[dead]; !ok || len(me) != 1 {
+		t.Errorf("GetMulti errors = %v, want only %s", me, dead)
+	}
+	if len(is) != len(live) {
+		t.Errorf("GetMulti got %d items, want %d", len(is), len(live))
+	}
+	for _, key := range live {
+		if i, ok := is[key]; !ok || string(i.Value) != key {
+			t.Errorf("GetMulti missing %q", key)
+		}
+	}
+}
+
+func TestClientCluster(t *testing.T) {
+	servers := make(map[string]*memcachetest.Server)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s := memcachetest.NewServer()
+		defer s.Close()
+		servers[s.Addr()] = s
+		addrs = append(addrs, s.Addr())
+	}
+	c, err := NewCluster(addrs, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	var keys []string
+	want := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key := "cluster" + strconv.Itoa(i)
+		keys = append(keys, key)
+		if err := c.Set(ctx, &Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+		addr, _ := c.selector.PickServer(key)
+		want[addr]++
+	}
+	for addr, s := range servers {
+		if s.Len() != want[addr] {
+			t.Errorf("%s holds %d items, want %d", addr, s.Len(), want[addr])
+		}
+		if s.Len() == 0 {
+			t.Errorf("%s holds no items", addr)
+		}
+	}
+
+	is, err := c.GetMulti(ctx, keys)
+	if err != nil || len(is) != len(keys) {
+		t.Errorf("GetMulti got %d items, %v", len(is), err)
+	}
+}
+
+func TestClientFaults(t *testing.T) {
+	p := memcachetest.NewProxy(os.Getenv("MC_ADDRESS"))
+	defer p.Close()
+	c, err := NewWithOptions(Options{
+		Addrs:       []string{p.Addr()},
+		PoolSize:    1,
+		ReadTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every fault must fail the command and discard the connection, the
+	// next command then succeeds on a new one.
+	faults := []struct {
+		name    string
+		fault   memcachetest.Fault
+		latency time.Duration
+	}{
+		{"drop", memcachetest.Drop, 0},
+		{"truncate", memcachetest.Truncate, 0},
+		{"blackhole", memcachetest.Blackhole, 0},
+		{"latency", memcachetest.NoFault, 200 * time.Millisecond},
+	}
+	for _, f := range faults {
+		conns := p.Accepted()
+		p.SetFault(f.fault)
+		p.SetLatency(f.latency)
+		if _, err := c.Get(ctx, "foo"); err == nil || IsResumableErr(err) {
+			t.Errorf("%s: Get want fatal error, got %v", f.name, err)
+		}
+		p.SetFault(memcachetest.NoFault)
+		p.SetLatency(0)
+		if item, err := c.Get(ctx, "foo"); err != nil || string(item.Value) != "foobar" {
+			t.Errorf("%s: Get after fault = %+v, %v", f.name, item, err)
+		}
+		if n := p.Accepted(); n != conns+1 {
+			t.Errorf("%s: %d connections opened, want 1", f.name, n-conns)
+		}
+	}
+
+	p.SetFault(memcachetest.OutOfMemory)
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("x")}); err == nil {
+		t.Error("Set on server out of memory should fail")
+	}
+	p.SetFault(memcachetest.NoFault)
+	if item, err := c.Get(ctx, "foo"); err != nil || string(item.Value) != "foobar" {
+		t.Errorf("Get after out of memory = %+v, %v", item, err)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
@@ -31,6 +30,10 @@ var (
 	// Keys must be at maximum 250 bytes long and not
 	// contain whitespace or control characters.
 	ErrMalformedKey = errors.New("malformed: key is too long or contains invalid characters")
+
+	// ErrNotSupported is returned when a command is not available in the
+	// protocol spoken by the client.
+	ErrNotSupported = errors.New("memcache: command not supported by protocol")
 )
 
 var (
@@ -45,7 +48,11 @@ var (
 	resultOk        = []byte("OK\r\n")
 	resultError     = []byte("ERROR\r\n")
 	resultTouched   = []byte("TOUCHED\r\n")
+	resultReset     = []byte("RESET\r\n")
+	resultMetaNoop  = []byte("MN\r\n")
 
+	resultValuePrefix       = []byte("VALUE ")
+	resultStatPrefix        = []byte("STAT ")
 	resultClientErrorPrefix = []byte("CLIENT_ERROR ")
 	resultServerErrorPrefix = []byte("SERVER_ERROR ")
 )
@@ -54,15 +61,41 @@ var (
 // It is safe for unlocked use by multiple concurrent goroutines.
 type Conn struct {
 	rw *bufio.ReadWriter
+	// nc is the connection of rw, nil for a command over a multiplexed
+	// connection.
+	nc net.Conn
+
+	// noreply is set when noreply commands have been written since the
+	// last Sync.
+	noreply bool
+	// pooled is set if values are read into buffers of the value pool.
+	pooled bool
+	// mux is set if c is a command over a multiplexed connection.
+	mux *muxRequest
 }
 
 // NewConn create a new memcache connection.
 func NewConn(c net.Conn) *Conn {
-	r := bufio.NewReader(c)
-	w := bufio.NewWriter(c)
-	rw := bufio.NewReadWriter(r, w)
+	return newConnSize(c, defaultBufferSize, defaultBufferSize)
+}
+
+func newConnSize(c net.Conn, readSize, writeSize int) *Conn {
+	rw := bufio.NewReadWriter(newReader(c, readSize), newWriter(c, writeSize))
+
+	return &Conn{rw: rw, nc: c}
+}
+
+// release recycles the buffers of c after its connection has been closed.
+func (c *Conn) release() {
+	releaseReadWriter(c.rw)
+}
 
-	return &Conn{rw}
+// flush sends the buffered command to the server.
+func (c *Conn) flush() error {
+	if c.mux != nil {
+		return c.mux.send()
+	}
+	return c.rw.Flush()
 }
 
 // Item is an item to be got or stored in a memcached server.
@@ -82,31 +115,29 @@ type Item struct {
 	// Zero means the Item has no expiration time.
 	Expiration int32
 
-	// Compare and swap ID.
-	casid uint64
+	// CAS is the compare and swap ID set by the get commands. It is used by
+	// CompareAndSwap and may be kept, e.g. with the serialized item, to
+	// compare and swap from another process.
+	CAS uint64
+
+	// pooled is set if Value is a buffer of the value pool.
+	pooled bool
 }
 
-// Get gets the item for the given key. ErrCacheMiss is returned for a
-// memcache cache miss. The key must be at most 250 bytes in length.
+// Get gets the item for the given key, with its CAS. ErrCacheMiss is
+// returned for a memcache cache miss. The key must be at most 250 bytes in
+// length.
 func (c *Conn) Get(key string) (*Item, error) {
-	if _, err := fmt.Fprintf(c.rw, "get %s\r\n", key); err != nil {
+	c.rw.WriteString("gets ")
+	c.rw.WriteString(key)
+	if _, err := c.rw.Write(crlf); err != nil {
 		return nil, err
 	}
-	if err := c.rw.Flush(); err != nil {
+	if err := c.flush(); err != nil {
 		return nil, err
 	}
 
-	items, err := parseGetResponse(c.rw.Reader)
-	if err != nil {
-		return nil, err
-	}
-
-	it, ok := items[key]
-	if !ok {
-		return nil, ErrCacheMiss
-	}
-
-	return it, nil
+	return parseGetOne(c.rw.Reader, key, c.pooled)
 }
 
 // GetMulti is a batch version of Get. The returned map from keys to
@@ -117,72 +148,178 @@ func (c *Conn) GetMulti(keys []string) (map[string]*Item, error) {
 	if _, err := fmt.Fprintf(c.rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
 		return nil, err
 	}
-	if err := c.rw.Flush(); err != nil {
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	return parseGetResponse(c.rw.Reader, c.pooled)
+}
+
+// GetAndTouch gets the item for the given key and updates its expiry.
+// ErrCacheMiss is returned for a memcache cache miss.
+func (c *Conn) GetAndTouch(key string, seconds int32) (*Item, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	if _, err := fmt.Fprintf(c.rw, "gats %d %s\r\n", seconds, key); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	return parseGetOne(c.rw.Reader, key, c.pooled)
+}
+
+// GetAndTouchMulti is a batch version of GetAndTouch. The returned map
+// from keys to items may have fewer elements than the input slice, due to
+// memcache cache misses.
+func (c *Conn) GetAndTouchMulti(keys []string, seconds int32) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, ErrMalformedKey
+		}
+	}
+	if _, err := fmt.Fprintf(c.rw, "gats %d %s\r\n", seconds, strings.Join(keys, " ")); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
 		return nil, err
 	}
 
-	return parseGetResponse(c.rw.Reader)
+	return parseGetResponse(c.rw.Reader, c.pooled)
 }
 
-func parseGetResponse(r *bufio.Reader) (map[string]*Item, error) {
+func parseGetResponse(r *bufio.Reader, pooled bool) (map[string]*Item, error) {
 	items := make(map[string]*Item)
 
 	for {
-		line, err := r.ReadSlice('\n')
+		it, err := readItem(r, "", pooled)
 		if err != nil {
 			return nil, err
 		}
-		if bytes.Equal(line, resultEnd) {
-			return items, err
-		}
-		it := new(Item)
-		size, err := scanGetResponseLine(line, it)
-		if err != nil {
-			return nil, err
-		}
-		it.Value, err = ioutil.ReadAll(io.LimitReader(r, int64(size)+2))
-		if err != nil {
-			return nil, err
+		if it == nil {
+			return items, nil
 		}
-		if !bytes.HasSuffix(it.Value, crlf) {
-			return nil, fmt.Errorf("memcache: corrupt get result read")
-		}
-		it.Value = it.Value[:size]
 		items[it.Key] = it
 	}
 }
 
+// parseGetOne reads the response of a get of the single key.
+func parseGetOne(r *bufio.Reader, key string, pooled bool) (*Item, error) {
+	it, err := readItem(r, key, pooled)
+	if err != nil {
+		return nil, err
+	}
+	if it == nil {
+		return nil, ErrCacheMiss
+	}
+
+	end, err := readItem(r, key, pooled)
+	if err != nil {
+		return nil, err
+	}
+	if end != nil {
+		return nil, fmt.Errorf("memcache: unexpected item %q in get response", end.Key)
+	}
+
+	return it, nil
+}
+
+// readItem reads the next item of a get response. It returns nil at the
+// end of the response. The key of the item reuses key if they are equal.
+// The value is read into a buffer of the value pool if pooled.
+func readItem(r *bufio.Reader, key string, pooled bool) (*Item, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(line, resultEnd) {
+		return nil, nil
+	}
+
+	it := new(Item)
+	size, err := scanGetResponseLine(line, it, key)
+	if err != nil {
+		return nil, err
+	}
+	it.Value = newValue(size+len(crlf), pooled)
+	it.pooled = pooled
+	if _, err := io.ReadFull(r, it.Value); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(it.Value, crlf) {
+		return nil, fmt.Errorf("memcache: corrupt get result read")
+	}
+	it.Value = it.Value[:size]
+
+	return it, nil
+}
+
 // scanGetResponseLine populates it and returns the declared size of the item.
-// It does not read the bytes of the item.
-func scanGetResponseLine(line []byte, it *Item) (size int, err error) {
-	pattern := "VALUE %s %d %d %d\r\n"
-	dest := []interface{}{&it.Key, &it.Flags, &size, &it.casid}
-	if bytes.Count(line, space) == 3 {
-		pattern = "VALUE %s %d %d\r\n"
-		dest = dest[:3]
-	}
-	n, err := fmt.Sscanf(string(line), pattern, dest...)
-	if err != nil || n != len(dest) {
+// It does not read the bytes of the item. The key of the item reuses key if
+// they are equal.
+func scanGetResponseLine(line []byte, it *Item, key string) (size int, err error) {
+	if !bytes.HasPrefix(line, resultValuePrefix) || !bytes.HasSuffix(line, crlf) {
+		return -1, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+	}
+
+	k, rest := nextToken(line[len(resultValuePrefix) : len(line)-len(crlf)])
+	flags, rest := nextToken(rest)
+	n, rest := nextToken(rest)
+	cas, rest := nextToken(rest)
+	if len(k) == 0 || len(rest) > 0 {
+		return -1, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+	}
+
+	if string(k) == key {
+		it.Key = key
+	} else {
+		it.Key = string(k)
+	}
+	if it.Flags, err = parseUint32(flags); err != nil {
+		return -1, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+	}
+	if size, err = parseSize(n); err != nil {
 		return -1, fmt.Errorf("memcache: unexpected line in get response: %q", line)
 	}
+	if len(cas) > 0 {
+		if it.CAS, err = parseUint(cas); err != nil {
+			return -1, fmt.Errorf("memcache: unexpected line in get response: %q", line)
+		}
+	}
 	return size, nil
 }
 
 // Set writes the given item, unconditionally.
 func (c *Conn) Set(item *Item) error {
-	return c.populateOne(c.rw, "set", item)
+	return c.populateOne("set", item)
 }
 
 // Add writes the given item, if no value already exists for its
 // key. ErrNotStored is returned if that condition is not met.
 func (c *Conn) Add(item *Item) error {
-	return c.populateOne(c.rw, "add", item)
+	return c.populateOne("add", item)
 }
 
 // Replace writes the given item, but only if the server *does*
 // already hold data for this key
 func (c *Conn) Replace(item *Item) error {
-	return c.populateOne(c.rw, "replace", item)
+	return c.populateOne("replace", item)
+}
+
+// Append adds the value of the given item after the value already held
+// for its key. The flags and expiration of the item are ignored.
+// ErrNotStored is returned if the server holds no data for the key.
+func (c *Conn) Append(item *Item) error {
+	return c.populateOne("append", item)
+}
+
+// Prepend adds the value of the given item before the value already held
+// for its key. The flags and expiration of the item are ignored.
+// ErrNotStored is returned if the server holds no data for the key.
+func (c *Conn) Prepend(item *Item) error {
+	return c.populateOne("prepend", item)
 }
 
 // CompareAndSwap writes the given item that was previously returned
@@ -193,36 +330,36 @@ func (c *Conn) Replace(item *Item) error {
 // calls. ErrNotStored is returned if the value was evicted in between
 // the calls.
 func (c *Conn) CompareAndSwap(item *Item) error {
-	return c.populateOne(c.rw, "cas", item)
+	return c.populateOne("cas", item)
 }
 
-func (c *Conn) populateOne(rw *bufio.ReadWriter, verb string, item *Item) error {
+func (c *Conn) populateOne(verb string, item *Item) error {
 	if !legalKey(item.Key) {
 		return ErrMalformedKey
 	}
 
 	var err error
 	if verb == "cas" {
-		_, err = fmt.Fprintf(rw, "%s %s %d %d %d %d\r\n",
-			verb, item.Key, item.Flags, item.Expiration, len(item.Value), item.casid)
+		_, err = fmt.Fprintf(c.rw, "%s %s %d %d %d %d\r\n",
+			verb, item.Key, item.Flags, item.Expiration, len(item.Value), item.CAS)
 	} else {
-		_, err = fmt.Fprintf(rw, "%s %s %d %d %d\r\n",
+		_, err = fmt.Fprintf(c.rw, "%s %s %d %d %d\r\n",
 			verb, item.Key, item.Flags, item.Expiration, len(item.Value))
 	}
 	if err != nil {
 		return err
 	}
-	if _, err = rw.Write(item.Value); err != nil {
+	if _, err = c.rw.Write(item.Value); err != nil {
 		return err
 	}
-	if _, err := rw.Write(crlf); err != nil {
+	if _, err := c.rw.Write(crlf); err != nil {
 		return err
 	}
-	if err := rw.Flush(); err != nil {
+	if err := c.flush(); err != nil {
 		return err
 	}
 
-	line, err := rw.ReadSlice('\n')
+	line, err := c.rw.ReadSlice('\n')
 	if err != nil {
 		return err
 	}
@@ -240,20 +377,20 @@ func (c *Conn) populateOne(rw *bufio.ReadWriter, verb string, item *Item) error
 	return fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
 }
 
-func writeReadLine(rw *bufio.ReadWriter, format string, args ...interface{}) ([]byte, error) {
-	_, err := fmt.Fprintf(rw, format, args...)
+func (c *Conn) writeReadLine(format string, args ...interface{}) ([]byte, error) {
+	_, err := fmt.Fprintf(c.rw, format, args...)
 	if err != nil {
 		return nil, err
 	}
-	if err := rw.Flush(); err != nil {
+	if err := c.flush(); err != nil {
 		return nil, err
 	}
-	line, err := rw.ReadSlice('\n')
+	line, err := c.rw.ReadSlice('\n')
 	return line, err
 }
 
-func writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...interface{}) error {
-	line, err := writeReadLine(rw, format, args...)
+func (c *Conn) writeExpectf(expect []byte, format string, args ...interface{}) error {
+	line, err := c.writeReadLine(format, args...)
 	if err != nil {
 		return err
 	}
@@ -277,7 +414,7 @@ func writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...in
 // Delete deletes the item with the provided key. The error ErrCacheMiss is
 // returned if the item didn't already exist in the cache.
 func (c *Conn) Delete(key string) error {
-	return writeExpectf(c.rw, resultDeleted, "delete %s\r\n", key)
+	return c.writeExpectf(resultDeleted, "delete %s\r\n", key)
 }
 
 // Increment atomically increments key by delta. The return value is
@@ -301,7 +438,7 @@ func (c *Conn) Decrement(key string, delta uint64) (newValue uint64, err error)
 
 func (c *Conn) incrDecr(verb, key string, delta uint64) (uint64, error) {
 	var val uint64
-	line, err := writeReadLine(c.rw, "%s %s %d\r\n", verb, key, delta)
+	line, err := c.writeReadLine("%s %s %d\r\n", verb, key, delta)
 	if err != nil {
 		return val, err
 	}
@@ -322,16 +459,16 @@ func (c *Conn) incrDecr(verb, key string, delta uint64) (uint64, error) {
 // into the future at which time the item will expire. ErrCacheMiss is returned if the
 // key is not in the cache. The key must be at most 250 bytes in length.
 func (c *Conn) Touch(key string, seconds int32) (err error) {
-	return writeExpectf(c.rw, resultTouched, "touch %s %d\r\n", key, seconds)
+	return c.writeExpectf(resultTouched, "touch %s %d\r\n", key, seconds)
 }
 
 // FlushAll clear all item
 func (c *Conn) FlushAll() error {
-	return writeExpectf(c.rw, resultOk, "flush_all\r\n")
+	return c.writeExpectf(resultOk, "flush_all\r\n")
 }
 
 func (c *Conn) ping() error {
-	return writeExpectf(c.rw, resultError, "ping\r\n")
+	return c.writeExpectf(resultError, "ping\r\n")
 }
 
 // IsResumableErr returns true if err is only a protocol-level cache error.
@@ -339,8 +476,16 @@ func (c *Conn) ping() error {
 // be re-used or not. If an error occurs, by default we don't reuse the
 // connection, unless it was just a cache error.
 func IsResumableErr(err error) bool {
+	switch err.(type) {
+	case SyncError:
+		// Sync has read all responses, the connection is in a clean state.
+		return true
+	case *versionError:
+		// The version reply has been read like any other.
+		return true
+	}
 	switch err {
-	case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey:
+	case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey, ErrNotSupported, ErrShutdownDisabled:
 		return true
 	case nil:
 		return true
@@ -353,27 +498,39 @@ func (c *Conn) metaCmd(cmd, key string, flags []metaFlag, data []byte) (mr MetaR
 		err = ErrMalformedKey
 		return
 	}
-	withPayload := data != nil
-	if withPayload {
-		_, err = fmt.Fprintf(c.rw, "%s %s %d %s\r\n", cmd, key, len(data), buildMetaFlags(flags))
-	} else {
-		_, err = fmt.Fprintf(c.rw, "%s %s %s\r\n", cmd, key, buildMetaFlags(flags))
+	if err = c.writeMetaCmd(cmd, key, flags, data); err != nil {
+		return
 	}
-	if err != nil {
+	if err = c.flush(); err != nil {
 		return
 	}
-	if withPayload {
+	mr, err = parseMetaResponse(c.rw.Reader, c.pooled)
+	return
+}
+
+func (c *Conn) writeMetaCmd(cmd, key string, flags []metaFlag, data []byte) (err error) {
+	// The command is written piece by piece, formatting it would allocate.
+	// The writer keeps its first error, which the last write returns.
+	c.rw.WriteString(cmd)
+	c.rw.WriteByte(' ')
+	c.rw.WriteString(key)
+	if data != nil {
+		c.rw.WriteByte(' ')
+		c.rw.WriteString(strconv.Itoa(len(data)))
+	}
+	for _, f := range flags {
+		c.rw.WriteByte(' ')
+		c.rw.WriteString(f)
+	}
+	if _, err = c.rw.Write(crlf); err != nil {
+		return
+	}
+	if data != nil {
 		if _, err = c.rw.Write(data); err != nil {
 			return
 		}
-		if _, err = c.rw.Write(crlf); err != nil {
-			return
-		}
-	}
-	if err = c.rw.Flush(); err != nil {
-		return
+		_, err = c.rw.Write(crlf)
 	}
-	mr, err = parseMetaResponse(c.rw.Reader)
 	return
 }
 
@@ -389,42 +546,54 @@ func legalKey(key string) bool {
 	return true
 }
 
-func parseMetaResponse(r *bufio.Reader) (mr MetaResult, err error) {
-	statusLineRaw, err := r.ReadSlice('\n')
+func parseMetaResponse(r *bufio.Reader, pooled bool) (mr MetaResult, err error) {
+	line, err := r.ReadSlice('\n')
 	if err != nil {
 		return
 	}
+	if len(line) < 4 || !bytes.HasSuffix(line, crlf) || len(line) > 4 && line[2] != ' ' {
+		err = fmt.Errorf("memcache: unexpected line in response: %q", line)
+		return
+	}
 
-	status := strings.Fields(string(statusLineRaw))
-	code, size, withValue, status := status[0], 0, false, status[1:]
-	switch code {
+	code, flags := line[:2], line[2:len(line)-len(crlf)]
+	size, withValue := 0, false
+	// The flags are parsed for the failure codes as well, the opaque token
+	// of a pipelined command comes back with them.
+	var codeErr error
+	switch string(code) {
 	case "MN":
 		mr.isNoOp = true
+		return
 	case "VA":
-		size, err = strconv.Atoi(status[0])
-		status, withValue = status[1:], true
+		var n []byte
+		n, flags = nextToken(flags)
+		if size, err = parseSize(n); err != nil {
+			return
+		}
+		withValue = true
 	case "NS":
-		err = ErrNotStored
+		codeErr = ErrNotStored
 	case "EX":
-		err = ErrCASConflict
+		codeErr = ErrCASConflict
 	case "EN", "NF":
-		err = ErrCacheMiss
+		codeErr = ErrCacheMiss
 	case "HD":
 	default:
-		err = fmt.Errorf("memcache: unexpected line in response: %q", statusLineRaw)
-	}
-	if mr.isNoOp || err != nil {
+		err = fmt.Errorf("memcache: unexpected line in response: %q", line)
 		return
 	}
-	if mr, err = obtainMetaFlagsResults(status); err != nil {
+	if mr, err = obtainMetaFlagsResults(flags); err != nil {
 		return
 	}
 	if withValue {
-		mr.Value = make([]byte, size+len(crlf))
+		mr.Value = newValue(size+len(crlf), pooled)
+		mr.pooled = pooled
 		if _, err = io.ReadFull(r, mr.Value); err != nil {
 			return
 		}
 		mr.Value = mr.Value[:size]
 	}
+	err = codeErr
 	return
 }
@@ -1,6 +1,8 @@
 package memcache
 
 import (
+	"bufio"
+	"bytes"
 	"net"
 	"os"
 	"strings"
@@ -30,7 +32,7 @@ func TestPing(t *testing.T) {
 	}
 }
 
-func mustSetF(t *testing.T, c *Conn) func(*Item) {
+func mustSetF(t *testing.T, c conn) func(*Item) {
 	return func(it *Item) {
 		if err := c.Set(it); err != nil {
 			t.Fatalf("failed to Set %#v: %v", *it, err)
@@ -38,7 +40,7 @@ func mustSetF(t *testing.T, c *Conn) func(*Item) {
 	}
 }
 
-func testWithClient(t *testing.T, c *Conn) {
+func testWithClient(t *testing.T, c conn) {
 	if err := c.FlushAll(); err != nil {
 		t.Error(err)
 	}
@@ -113,6 +115,24 @@ func testWithClient(t *testing.T, c *Conn) {
 	err = c.Replace(bar)
 	checkErr(err, "replaced(foo): %v", err)
 
+	// Append/Prepend
+	if err := c.Append(&Item{Key: "log", Value: []byte("b")}); err != ErrNotStored {
+		t.Fatalf("append(log) of missing key want ErrNotStored, got %v", err)
+	}
+	if err := c.Prepend(&Item{Key: "log", Value: []byte("a")}); err != ErrNotStored {
+		t.Fatalf("prepend(log) of missing key want ErrNotStored, got %v", err)
+	}
+	mustSet(&Item{Key: "log", Value: []byte("b"), Flags: 5})
+	err = c.Append(&Item{Key: "log", Value: []byte("c"), Flags: 9})
+	checkErr(err, "append(log): %v", err)
+	err = c.Prepend(&Item{Key: "log", Value: []byte("a")})
+	checkErr(err, "prepend(log): %v", err)
+	it, err = c.Get("log")
+	checkErr(err, "get(log): %v", err)
+	if string(it.Value) != "abc" || it.Flags != 5 {
+		t.Errorf("get(log) = %q flags %d, want abc flags 5", it.Value, it.Flags)
+	}
+
 	// GetMulti
 	m, err := c.GetMulti([]string{"foo", "bar"})
 	checkErr(err, "GetMulti: %v", err)
@@ -132,6 +152,21 @@ func testWithClient(t *testing.T, c *Conn) {
 		t.Errorf("GetMulti: bar: got %q, want %q", g, e)
 	}
 
+	// GetAndTouch
+	it, err = c.GetAndTouch("foo", 100)
+	checkErr(err, "GetAndTouch(foo): %v", err)
+	if string(it.Value) != "fooval" || it.Flags != 123 || it.CAS == 0 {
+		t.Errorf("GetAndTouch(foo) = %+v", it)
+	}
+	if _, err := c.GetAndTouch("missing", 100); err != ErrCacheMiss {
+		t.Errorf("GetAndTouch(missing) want ErrCacheMiss, got %v", err)
+	}
+	m, err = c.GetAndTouchMulti([]string{"foo", "bar", "missing"}, 100)
+	checkErr(err, "GetAndTouchMulti: %v", err)
+	if len(m) != 2 || string(m["bar"].Value) != "barval" || m["bar"].CAS == 0 {
+		t.Errorf("GetAndTouchMulti = %v", m)
+	}
+
 	// Delete
 	err = c.Delete("foo")
 	checkErr(err, "Delete: %v", err)
@@ -177,7 +212,7 @@ func testWithClient(t *testing.T, c *Conn) {
 	}
 }
 
-func testTouch(t *testing.T, c *Conn) {
+func testTouch(t *testing.T, c conn) {
 	const secondsToExpiry = int32(2)
 
 	// We will set foo and bar to expire in 2 seconds, then we'll keep touching
@@ -217,3 +252,118 @@ func testTouch(t *testing.T, c *Conn) {
 		}
 	}
 }
+
+func TestParseResponses(t *testing.T) {
+	var it Item
+	size, err := scanGetResponseLine([]byte("VALUE foo 123 6 42\r\n"), &it, "foo")
+	if err != nil || size != 6 || it.Key != "foo" || it.Flags != 123 || it.CAS != 42 {
+		t.Errorf("scanGetResponseLine = %+v, %d, %v", it, size, err)
+	}
+	it = Item{}
+	size, err = scanGetResponseLine([]byte("VALUE bar 4294967295 0\r\n"), &it, "")
+	if err != nil || size != 0 || it.Key != "bar" || it.Flags != 4294967295 || it.CAS != 0 {
+		t.Errorf("scanGetResponseLine without CAS = %+v, %d, %v", it, size, err)
+	}
+	for _, line := range []string{
+		"VALUE foo 123\r\n",
+		"VALUE foo 4294967296 6\r\n",
+		"VALUE foo 1 -6\r\n",
+		"VALUE foo 1 6 42 7\r\n",
+		"VALUE foo 1 6x\r\n",
+		"VALUE foo 1 6",
+		"END\r\n",
+	} {
+		if _, err := scanGetResponseLine([]byte(line), &it, ""); err == nil {
+			t.Errorf("scanGetResponseLine(%q) should fail", line)
+		}
+	}
+
+	parse := func(resp string) (MetaResult, error) {
+		return parseMetaResponse(bufio.NewReader(strings.NewReader(resp)), false)
+	}
+	mr, err := parse("VA 3 c18446744073709551615 f7 t-1 s3 h1 l20 kfoo Oop W X\r\nbar\r\n")
+	if err != nil || string(mr.Value) != "bar" || mr.CasToken.Value() != 18446744073709551615 ||
+		mr.Flags != 7 || mr.TTL != -1 || mr.Size != 3 || !mr.Hit || mr.LastAccess != 20 ||
+		mr.Key != "foo" || mr.Opaque != "op" || !mr.Won || !mr.Stale {
+		t.Errorf("parseMetaResponse = %+v, %v", mr, err)
+	}
+	if mr, err := parse("HD\r\n"); err != nil || !mr.CasToken.IsSet() {
+		t.Errorf("parseMetaResponse(HD) = %+v, %v", mr, err)
+	}
+	if mr, err := parse("NS Oop\r\n"); err != ErrNotStored || mr.Opaque != "op" {
+		t.Errorf("parseMetaResponse(NS) = %+v, %v", mr, err)
+	}
+	if mr, _ := parse("MN\r\n"); !mr.isNoOp {
+		t.Error("parseMetaResponse(MN) is not a no-op")
+	}
+	for _, resp := range []string{"VA x\r\n", "HD c-1\r\n", "HD y1\r\n", "HDc1\r\n", "OK\r\n", "H\r\n"} {
+		if _, err := parse(resp); err == nil || IsResumableErr(err) {
+			t.Errorf("parseMetaResponse(%q) = %v, want a fatal error", resp, err)
+		}
+	}
+}
+
+// replayConn answers every write with the same canned response.
+type replayConn struct {
+	net.Conn
+	resp []byte
+	r    bytes.Reader
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.r.Reset(c.resp)
+	return len(p), nil
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func BenchmarkParseGetResponse(b *testing.B) {
+	resp := []byte("VALUE foo 123 6 42\r\nfooval\r\nEND\r\n")
+	r := bytes.NewReader(resp)
+	br := bufio.NewReader(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(resp)
+		br.Reset(r)
+		if _, err := parseGetResponse(br, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseMetaResponse(b *testing.B) {
+	resp := []byte("VA 6 c42 f123 t-1 s6\r\nfooval\r\n")
+	r := bytes.NewReader(resp)
+	br := bufio.NewReader(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(resp)
+		br.Reset(r)
+		if _, err := parseMetaResponse(br, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnGet(b *testing.B) {
+	c := NewConn(&replayConn{resp: []byte("VALUE foo 123 6 42\r\nfooval\r\nEND\r\n")})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Get("foo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnMetaGet(b *testing.B) {
+	c := NewConn(&replayConn{resp: []byte("VA 6 c42 f123 t-1 s6\r\nfooval\r\n")})
+	flags := MetaGetOptions{GetCasToken: true, GetFlags: true, GetTTL: true, GetSize: true, GetValue: true}.marshal()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.metaCmd("mg", "foo", flags, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
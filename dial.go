@@ -0,0 +1,55 @@
+package memcache
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+const unixPrefix = "unix://"
+
+// dial connects to addr and performs the TLS handshake if the client is
+// configured to use TLS. The handshake is bounded by the ctx deadline.
+//
+// Addresses like unix:///var/run/memcached.sock are unix domain sockets,
+// all others are TCP addresses, unless a custom dialer is configured.
+func dial(ctx context.Context, addr string, o Options) (net.Conn, error) {
+	var nc net.Conn
+	var err error
+	if o.Dialer != nil {
+		nc, err = o.Dialer(ctx, addr)
+	} else if strings.HasPrefix(addr, unixPrefix) {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "unix", strings.TrimPrefix(addr, unixPrefix))
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.TLSConfig == nil {
+		return nc, nil
+	}
+
+	cfg := o.TLSConfig.Clone()
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+
+	tc := tls.Client(nc, cfg)
+	if d, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(d)
+	}
+	if err := tc.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+
+	return tc, nil
+}
@@ -0,0 +1,183 @@
+package memcache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate valid for memcached.test and
+// 127.0.0.1, usable by both TLS servers and clients.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "memcached.test"},
+		DNSNames:              []string{"memcached.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// forward copies data between c and a new connection to addr.
+func forward(c net.Conn, addr string) {
+	defer c.Close()
+	u, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer u.Close()
+	go io.Copy(u, c)
+	io.Copy(c, u)
+}
+
+// forwarder forwards the connections accepted by ln to addr.
+func forwarder(ln net.Listener, addr string) net.Listener {
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go forward(c, addr)
+		}
+	}()
+	return ln
+}
+
+// tlsForwarder accepts TLS connections and forwards them to addr.
+func tlsForwarder(t *testing.T, cfg *tls.Config, addr string) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwarder(ln, addr)
+}
+
+func TestClientTLS(t *testing.T) {
+	cert, roots := testCert(t)
+	sni := make(chan string, 10)
+	ln := tlsForwarder(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	}, os.Getenv("MC_ADDRESS"))
+	defer ln.Close()
+
+	ctx := context.Background()
+	c, _ := New(ln.Addr().String(), 0, 10, WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   "memcached.test",
+	}))
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := c.Get(ctx, "foo"); err != nil || string(item.Value) != "bar" {
+		t.Fatalf("Get = %+v, %v", item, err)
+	}
+	if name := <-sni; name != "memcached.test" {
+		t.Errorf("server got SNI %q", name)
+	}
+
+	// Without ServerName the certificate is verified against the address.
+	c, _ = New(ln.Addr().String(), 0, 10, WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+	}))
+	if _, err := c.Get(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An untrusted server fails the handshake.
+	c, _ = New(ln.Addr().String(), 0, 10, WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}))
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := c.Get(ctx, "foo"); err == nil {
+		t.Error("Get from untrusted server should fail")
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "memcached.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder(ln, os.Getenv("MC_ADDRESS")).Close()
+
+	ctx := context.Background()
+	c, _ := New("unix://"+path, 0, 10)
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := c.Get(ctx, "foo"); err != nil || string(item.Value) != "bar" {
+		t.Fatalf("Get = %+v, %v", item, err)
+	}
+}
+
+func TestClientDialer(t *testing.T) {
+	var dialed []string
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		c, s := net.Pipe()
+		go forward(s, os.Getenv("MC_ADDRESS"))
+		return c, nil
+	}
+
+	ctx := context.Background()
+	c, _ := New("pipe", 0, 1, WithDialer(dialer))
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := c.Get(ctx, "foo"); err != nil || string(item.Value) != "bar" {
+		t.Fatalf("Get = %+v, %v", item, err)
+	}
+	if len(dialed) != 1 || dialed[0] != "pipe" {
+		t.Errorf("dialed %q", dialed)
+	}
+}
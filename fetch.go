@@ -0,0 +1,137 @@
+package memcache
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultFetchLockTTL       = 30
+	defaultFetchRetryInterval = 20 * time.Millisecond
+)
+
+// FetchOptions configures Fetch.
+type FetchOptions struct {
+	Key string // the key of item
+
+	// TTL is the TTL in seconds of the computed value. Zero means the
+	// value does not expire.
+	TTL uint64
+	// RecacheTTL makes one caller recompute the value once its remaining
+	// TTL drops below RecacheTTL seconds, while the others are still
+	// served the value. Zero means the value is only recomputed when it
+	// is missing or invalidated.
+	RecacheTTL uint64
+	// LockTTL is the TTL in seconds of the placeholder created on a miss
+	// for the winner to fill, 30 by default. The others wait for the value
+	// at most that long, then one of them wins in turn.
+	LockTTL uint64
+	// RetryInterval is how often the callers waiting for the value of a
+	// miss fetch it again, 20ms by default.
+	RetryInterval time.Duration
+}
+
+// FetchResult is the value returned by Fetch.
+type FetchResult struct {
+	Value []byte
+	// TTL is the remaining TTL of the value in seconds, -1 for unlimited.
+	TTL int64
+	// Stale is set if the value has been invalidated and is served while
+	// another caller recomputes it.
+	Stale bool
+	// Won is set if the value has been computed by this call.
+	Won bool
+}
+
+// Fetch gets the value of opts.Key, computing it with fn if it is missing,
+// invalidated or due for recache. Across all clients, exactly one caller,
+// the winner, runs fn and sets the value, with the meta get flags N, R, c
+// and t. The others are served the current or stale value meanwhile, or
+// wait for the value of a miss until ctx is done.
+//
+// The value is written back with Refill: if the item has been deleted
+// meanwhile, nothing is set, and if it has been invalidated meanwhile, it
+// is set but stays stale, so that the next caller recomputes it again.
+//
+// If fn fails, its error is returned together with the previous value, if
+// any, which callers may serve instead. The value is then invalidated, so
+// that the next caller recomputes it. If the cache fails, the value is
+// computed and returned without setting it. Fetch requires the meta
+// commands.
+func (c *Client) Fetch(ctx context.Context, opts FetchOptions, fn func(ctx context.Context) ([]byte, error)) (FetchResult, error) {
+	if opts.LockTTL == 0 {
+		opts.LockTTL = defaultFetchLockTTL
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultFetchRetryInterval
+	}
+
+	get := MetaGetOptions{
+		Key:              opts.Key,
+		GetValue:         true,
+		GetFlags:         true,
+		GetCasToken:      true,
+		GetTTL:           true,
+		SetVivifyWithTTL: opts.LockTTL,
+		RecacheWithTTL:   opts.RecacheTTL,
+	}
+	for {
+		mr, err := c.MetaGet(ctx, get)
+		switch {
+		case err == ErrNotSupported, err == ErrMalformedKey:
+			return FetchResult{}, err
+		case err != nil:
+			v, err := fn(ctx)
+			return FetchResult{Value: v, TTL: ttlOf(opts.TTL), Won: true}, err
+		}
+		r := leaseResult(opts.Key, mr, opts.LockTTL)
+		if r.Lease != nil {
+			return c.refill(ctx, opts, r, fn)
+		}
+		if !r.Placeholder {
+			return FetchResult{Value: r.Value, TTL: r.TTL, Stale: r.Stale}, nil
+		}
+
+		// The winner of the miss is computing the value.
+		t := time.NewTimer(opts.RetryInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return FetchResult{}, ctx.Err()
+		}
+	}
+}
+
+// refill computes the value of the item leased by the caller and refills
+// it.
+func (c *Client) refill(ctx context.Context, opts FetchOptions, r LeaseResult, fn func(ctx context.Context) ([]byte, error)) (FetchResult, error) {
+	v, err := fn(ctx)
+	if err != nil {
+		// Give the item up, unless it has changed since it was won: the
+		// server keeps it won until it is replaced, so that nobody would
+		// recompute it again. The placeholder is removed, so that the
+		// others do not wait for it to expire, a value is invalidated, so
+		// that the next caller wins it.
+		c.MetaDelete(ctx, MetaDeletOptions{
+			Key:           opts.Key,
+			CasToken:      r.Lease.cas,
+			SetInvalidate: !r.Placeholder,
+		})
+		return FetchResult{Value: r.Value, TTL: r.TTL, Stale: r.Stale}, err
+	}
+
+	// A miss means that the item has been deleted since it was won, the
+	// value is returned but not set.
+	c.Refill(ctx, r.Lease, v, opts.TTL)
+	return FetchResult{Value: v, TTL: ttlOf(opts.TTL), Won: true}, nil
+}
+
+// ttlOf returns the remaining TTL of a value just set with ttl, as
+// reported by the meta commands.
+func ttlOf(ttl uint64) int64 {
+	if ttl == 0 {
+		return -1
+	}
+	return int64(ttl)
+}
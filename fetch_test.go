@@ -0,0 +1,199 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestClientFetch(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 100)
+	defer c.Close()
+	opts := FetchOptions{Key: "fetch", TTL: 100, RecacheTTL: 30, RetryInterval: time.Millisecond}
+
+	// On a miss one caller computes the value, the others wait for it.
+	var calls int32
+	compute := func(v string) func(ctx context.Context) ([]byte, error) {
+		return func(ctx context.Context) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(20 * time.Millisecond)
+			return []byte(v), nil
+		}
+	}
+	var wg sync.WaitGroup
+	var won int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := c.Fetch(ctx, opts, compute("v1"))
+			if err != nil || string(r.Value) != "v1" {
+				t.Errorf("Fetch = %+v, %v", r, err)
+			}
+			if r.Won {
+				atomic.AddInt32(&won, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 || won != 1 {
+		t.Errorf("value computed %d times by %d winners, want 1", calls, won)
+	}
+
+	r, err := c.Fetch(ctx, opts, compute("unused"))
+	if err != nil || string(r.Value) != "v1" || r.Won || r.Stale || r.TTL != 100 {
+		t.Errorf("Fetch of a cached value = %+v, %v", r, err)
+	}
+
+	// Below the recache TTL one caller recomputes the value, the others
+	// are served the current one.
+	s.Advance(80 * time.Second)
+	done := make(chan FetchResult)
+	go func() {
+		r, _ := c.Fetch(ctx, opts, compute("v2"))
+		done <- r
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if r, err := c.Fetch(ctx, opts, compute("unused")); err != nil || string(r.Value) != "v1" || r.Won {
+		t.Errorf("Fetch during a recache = %+v, %v", r, err)
+	}
+	if r := <-done; string(r.Value) != "v2" || !r.Won {
+		t.Errorf("Fetch of the winner = %+v", r)
+	}
+	if calls != 2 {
+		t.Errorf("value computed %d times, want 2", calls)
+	}
+}
+
+func TestClientFetchEmpty(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+	opts := FetchOptions{Key: "fetch_empty", TTL: 100, RecacheTTL: 30, LockTTL: 10}
+	empty := func(ctx context.Context) ([]byte, error) { return []byte{}, nil }
+
+	if r, err := c.Fetch(ctx, opts, empty); err != nil || len(r.Value) != 0 || !r.Won {
+		t.Fatalf("Fetch = %+v, %v", r, err)
+	}
+
+	// An empty value being recomputed is served, not waited for as a
+	// placeholder, as long as it expires later than a placeholder would.
+	s.Advance(80 * time.Second)
+	r, err := c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) {
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if r, err := c.Fetch(tctx, opts, nil); err != nil || len(r.Value) != 0 || r.Won {
+			t.Errorf("Fetch of an empty value during a recache = %+v, %v", r, err)
+		}
+		return []byte{}, nil
+	})
+	if err != nil || len(r.Value) != 0 || !r.Won {
+		t.Errorf("Fetch of the winner = %+v, %v", r, err)
+	}
+}
+
+func TestClientFetchInvalidate(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+	opts := FetchOptions{Key: "fetch_inv", TTL: 100}
+	invalidate := func() {
+		if _, err := c.MetaDelete(ctx, MetaDeletOptions{Key: "fetch_inv", SetInvalidate: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) { return []byte("v1"), nil })
+	invalidate()
+
+	// The value is invalidated again while it is recomputed: it is set
+	// but stays stale, the others are served it and the next caller
+	// recomputes it.
+	r, err := c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) {
+		if r, err := c.Fetch(ctx, opts, nil); err != nil || string(r.Value) != "v1" || !r.Stale {
+			t.Errorf("Fetch of a stale value = %+v, %v", r, err)
+		}
+		invalidate()
+		return []byte("v2"), nil
+	})
+	if err != nil || string(r.Value) != "v2" || !r.Won {
+		t.Errorf("Fetch = %+v, %v", r, err)
+	}
+	r, err = c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) { return []byte("v3"), nil })
+	if err != nil || string(r.Value) != "v3" || !r.Won {
+		t.Errorf("Fetch = %+v, %v", r, err)
+	}
+	if r, err := c.Fetch(ctx, opts, nil); err != nil || string(r.Value) != "v3" || r.Stale {
+		t.Errorf("Fetch = %+v, %v", r, err)
+	}
+}
+
+func TestClientFetchError(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+	opts := FetchOptions{Key: "fetch_err", TTL: 100}
+
+	errFailed := errors.New("failed")
+	if _, err := c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) { return nil, errFailed }); err != errFailed {
+		t.Errorf("Fetch = %v", err)
+	}
+	// The placeholder of the failed winner has been removed, the next
+	// caller wins at once.
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	r, err := c.Fetch(tctx, opts, func(ctx context.Context) ([]byte, error) { return []byte("v1"), nil })
+	if err != nil || string(r.Value) != "v1" || !r.Won {
+		t.Errorf("Fetch after a failure = %+v, %v", r, err)
+	}
+
+	// A failed winner of a stale value serves it and gives the item up,
+	// the next caller wins it.
+	if err := c.Invalidate(ctx, "fetch_err"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) { return nil, errFailed })
+	if err != errFailed || string(r.Value) != "v1" || !r.Stale {
+		t.Errorf("Fetch of a failed stale winner = %+v, %v", r, err)
+	}
+	r, err = c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) { return []byte("v2"), nil })
+	if err != nil || string(r.Value) != "v2" || !r.Won {
+		t.Errorf("Fetch after a failed stale winner = %+v, %v", r, err)
+	}
+
+	// So does a failed winner of a recache.
+	ropts := FetchOptions{Key: "fetch_err", TTL: 100, RecacheTTL: 200}
+	r, err = c.Fetch(ctx, ropts, func(ctx context.Context) ([]byte, error) { return nil, errFailed })
+	if err != errFailed || string(r.Value) != "v2" {
+		t.Errorf("Fetch of a failed recache winner = %+v, %v", r, err)
+	}
+	r, err = c.Fetch(ctx, opts, func(ctx context.Context) ([]byte, error) { return []byte("v3"), nil })
+	if err != nil || string(r.Value) != "v3" || !r.Won {
+		t.Errorf("Fetch after a failed recache winner = %+v, %v", r, err)
+	}
+
+	s.SetVersion("1.5.22")
+	old, _ := New(s.Addr(), 0, 10)
+	defer old.Close()
+	if _, err := old.Fetch(ctx, opts, nil); err != ErrNotSupported {
+		t.Errorf("Fetch without meta commands = %v", err)
+	}
+}
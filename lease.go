@@ -0,0 +1,113 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrLeaseUsed is returned by Refill for a lease which has been used.
+var ErrLeaseUsed = errors.New("memcache: lease already used")
+
+// Lease is the right to refill a missing or invalidated item. It is only
+// handed out by LeaseGet to the single client winning the item.
+type Lease struct {
+	key   string
+	cas   CasToken
+	flags uint32
+	used  int32
+}
+
+// Key returns the key of the leased item.
+func (l *Lease) Key() string {
+	return l.key
+}
+
+// LeaseResult is the item returned by LeaseGet.
+type LeaseResult struct {
+	Value []byte
+	// TTL is the remaining TTL of the value in seconds, -1 for unlimited.
+	TTL int64
+	// Stale is set if the value has been invalidated.
+	Stale bool
+	// Placeholder is set if the item has been missing and has no value
+	// yet. It is filled by the holder of its lease. A placeholder is told
+	// apart from a value by being won, not stale, empty, without flags and
+	// within lockTTL of expiring: an empty value without flags is only
+	// taken for one while it is recomputed that close to its expiry.
+	Placeholder bool
+	// Lease is set if the caller won the item and is expected to refill
+	// it.
+	Lease *Lease
+}
+
+// Invalidate marks the item of key stale instead of deleting it. Readers
+// are still served the stale value while the first LeaseGet or Fetch wins
+// the right to refill it. The leases handed out before are outdated: their
+// refill is stored but stays stale. A missing item is not an error.
+func (c *Client) Invalidate(ctx context.Context, key string) error {
+	_, err := c.MetaDelete(ctx, MetaDeletOptions{Key: key, SetInvalidate: true})
+	if err == ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// LeaseGet gets the item of key and wins its lease if it is stale or, if
+// lockTTL is not zero, missing. A missing item is then replaced by an empty
+// placeholder for lockTTL seconds, while its lease holder refills it.
+// ErrCacheMiss is returned for a missing item if lockTTL is zero.
+func (c *Client) LeaseGet(ctx context.Context, key string, lockTTL uint64) (LeaseResult, error) {
+	mr, err := c.MetaGet(ctx, MetaGetOptions{
+		Key:              key,
+		GetValue:         true,
+		GetFlags:         true,
+		GetCasToken:      true,
+		GetTTL:           true,
+		SetVivifyWithTTL: lockTTL,
+	})
+	if err != nil {
+		return LeaseResult{}, err
+	}
+	return leaseResult(key, mr, lockTTL), nil
+}
+
+// leaseResult returns the LeaseResult of mr, read with the flags, the CAS
+// and the TTL of the item and vivified for lockTTL seconds on a miss.
+func leaseResult(key string, mr MetaResult, lockTTL uint64) LeaseResult {
+	r := LeaseResult{
+		Value: mr.Value,
+		TTL:   mr.TTL,
+		Stale: mr.Stale,
+		// A placeholder is won until it is refilled or deleted, and
+		// expires within lockTTL.
+		Placeholder: (mr.Won || mr.AlreadyWon) && !mr.Stale && len(mr.Value) == 0 &&
+			mr.Flags == 0 && mr.TTL >= 0 && uint64(mr.TTL) <= lockTTL,
+	}
+	if mr.Won {
+		r.Lease = &Lease{key: key, cas: mr.CasToken, flags: mr.Flags}
+	}
+	return r
+}
+
+// Refill sets the value of the item leased by l with the given TTL in
+// seconds. The value is stored with the CAS of the lease and the I flag,
+// so that it does not overwrite later changes: ErrCacheMiss is returned if
+// the item has been deleted since the lease was won. If it has been
+// invalidated or set since, the value is stored but stays stale, for the
+// next reader to refill it again. The flags of the item are kept. A lease
+// can be used once.
+func (c *Client) Refill(ctx context.Context, l *Lease, value []byte, ttl uint64) error {
+	if !atomic.CompareAndSwapInt32(&l.used, 0, 1) {
+		return ErrLeaseUsed
+	}
+	_, err := c.MetaSet(ctx, MetaSetOptions{
+		Key:           l.key,
+		Value:         value,
+		CasToken:      l.cas,
+		SetInvalidate: true,
+		SetTTL:        ttl,
+		SetFlag:       l.flags,
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+package memcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestClientLease(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+
+	if err := c.Invalidate(ctx, "lease"); err != nil {
+		t.Errorf("Invalidate of a missing item = %v", err)
+	}
+	if _, err := c.LeaseGet(ctx, "lease", 0); err != ErrCacheMiss {
+		t.Errorf("LeaseGet of a missing item = %v", err)
+	}
+
+	// A miss is leased to the first client only.
+	r, err := c.LeaseGet(ctx, "lease", 30)
+	if err != nil || r.Lease == nil || !r.Placeholder || r.Lease.Key() != "lease" {
+		t.Fatalf("LeaseGet = %+v, %v", r, err)
+	}
+	if r2, err := c.LeaseGet(ctx, "lease", 30); err != nil || r2.Lease != nil || !r2.Placeholder {
+		t.Errorf("second LeaseGet = %+v, %v", r2, err)
+	}
+	if err := c.Refill(ctx, r.Lease, []byte("v1"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refill(ctx, r.Lease, []byte("v1"), 100); err != ErrLeaseUsed {
+		t.Errorf("second Refill = %v", err)
+	}
+
+	// An invalidated item is still served, stale, and leased to the first
+	// client only.
+	if err := c.Invalidate(ctx, "lease"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = c.LeaseGet(ctx, "lease", 30)
+	if err != nil || r.Lease == nil || !r.Stale || string(r.Value) != "v1" || r.Placeholder {
+		t.Fatalf("LeaseGet of an invalidated item = %+v, %v", r, err)
+	}
+	if r2, err := c.LeaseGet(ctx, "lease", 30); err != nil || r2.Lease != nil || !r2.Stale || string(r2.Value) != "v1" {
+		t.Errorf("second LeaseGet = %+v, %v", r2, err)
+	}
+	if err := c.Refill(ctx, r.Lease, []byte("v2"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := c.LeaseGet(ctx, "lease", 30); err != nil || r.Lease != nil || r.Stale || string(r.Value) != "v2" || r.TTL != 100 {
+		t.Errorf("LeaseGet after Refill = %+v, %v", r, err)
+	}
+
+	// A refill after another invalidation is stored but stays stale.
+	c.Invalidate(ctx, "lease")
+	r, _ = c.LeaseGet(ctx, "lease", 30)
+	c.Invalidate(ctx, "lease")
+	if err := c.Refill(ctx, r.Lease, []byte("v3"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := c.LeaseGet(ctx, "lease", 30); err != nil || r.Lease == nil || !r.Stale || string(r.Value) != "v3" {
+		t.Errorf("LeaseGet after an outdated Refill = %+v, %v", r, err)
+	}
+
+	// An empty value is not taken for a placeholder.
+	r, _ = c.LeaseGet(ctx, "empty", 30)
+	if err := c.Refill(ctx, r.Lease, nil, 100); err != nil {
+		t.Fatal(err)
+	}
+	c.Invalidate(ctx, "empty")
+	c.LeaseGet(ctx, "empty", 30)
+	if r, err := c.LeaseGet(ctx, "empty", 30); err != nil || r.Placeholder || !r.Stale || len(r.Value) != 0 {
+		t.Errorf("LeaseGet of an empty value = %+v, %v", r, err)
+	}
+
+	// Neither is an empty value set otherwise, and the flags of an item
+	// are kept by Refill.
+	c.Set(ctx, &Item{Key: "empty", Flags: 7})
+	c.Invalidate(ctx, "empty")
+	r, err = c.LeaseGet(ctx, "empty", 30)
+	if err != nil || r.Placeholder || r.Lease == nil || !r.Stale {
+		t.Fatalf("LeaseGet of an empty value with flags = %+v, %v", r, err)
+	}
+	if err := c.Refill(ctx, r.Lease, []byte("v1"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if it, err := c.Get(ctx, "empty"); err != nil || it.Flags != 7 || string(it.Value) != "v1" {
+		t.Errorf("Get after Refill = %+v, %v", it, err)
+	}
+	c.Set(ctx, &Item{Key: "empty", Expiration: 20})
+	c.Invalidate(ctx, "empty")
+	if r, err := c.LeaseGet(ctx, "empty", 30); err != nil || r.Placeholder || r.Lease == nil || !r.Stale {
+		t.Errorf("LeaseGet of an empty value without flags = %+v, %v", r, err)
+	}
+	if r, err := c.LeaseGet(ctx, "empty", 30); err != nil || r.Placeholder || r.Lease != nil {
+		t.Errorf("second LeaseGet of an empty value without flags = %+v, %v", r, err)
+	}
+
+	// A refill after a delete is not stored.
+	r, _ = c.LeaseGet(ctx, "deleted", 30)
+	c.Delete(ctx, "deleted")
+	if err := c.Refill(ctx, r.Lease, []byte("v1"), 100); err != ErrCacheMiss {
+		t.Errorf("Refill after Delete = %v", err)
+	}
+	if _, err := c.Get(ctx, "deleted"); err != ErrCacheMiss {
+		t.Errorf("Get after a refused Refill = %v", err)
+	}
+}
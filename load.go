@@ -0,0 +1,238 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LoadFlagsReserved are the bits of the flags which GetOrLoad keeps its
+// metadata in: the values it writes are marked, and the loader duration of
+// a value is kept in milliseconds, up to about 16 seconds. Items without the mark are plain values to GetOrLoad,
+// whatever their other bits. The flags given with WithFlags must leave
+// these bits clear, and the items of other writers should.
+const LoadFlagsReserved uint32 = 0xffff0000
+
+const (
+	loadFlagEntry       uint32 = 1 << 31
+	loadFlagDuration    uint32 = 1<<30 - 1<<16
+	loadDurationShift          = 16
+	loadDurationMaxMsec        = loadFlagDuration >> loadDurationShift
+)
+
+// loadErrorPrefix prefixes the keys of the loader errors cached by
+// GetOrLoad, so that they are never read as the values of their keys.
+const loadErrorPrefix = "load_error:"
+
+// ErrReservedFlags is returned by GetOrLoad if the flags given with
+// WithFlags overlap LoadFlagsReserved.
+var ErrReservedFlags = errors.New("memcache: flags overlap the bits reserved by GetOrLoad")
+
+// loadRand draws the random factor of the early recomputes.
+var loadRand = rand.Float64
+
+var errLoaderPanic = errors.New("memcache: loader panicked")
+
+// LoadError is returned by GetOrLoad for a key whose loader failed
+// recently, while the failure is cached, see WithNegativeTTL.
+type LoadError struct {
+	Key string
+	// Msg is the message of the loader error.
+	Msg string
+}
+
+func (e *LoadError) Error() string {
+	return "memcache: cached load error of " + e.Key + ": " + e.Msg
+}
+
+// LoadOption configures a call of GetOrLoad.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	negativeTTL int32
+	beta        float64
+	flags       uint32
+}
+
+// WithNegativeTTL caches the errors of the loader for the given seconds.
+// Until then GetOrLoad returns a LoadError instead of calling the loader
+// again. Errors are not cached if ctx is done.
+//
+// The message of an error is cached under its own key, the key prefixed
+// with "load_error:", which is only looked up on a miss by the calls with
+// WithNegativeTTL. The other readers of key never see it. Errors are not
+// cached for keys too long to take the prefix.
+func WithNegativeTTL(seconds int32) LoadOption {
+	return func(o *loadOptions) {
+		o.negativeTTL = seconds
+	}
+}
+
+// WithEarlyRecompute makes GetOrLoad recompute values probabilistically
+// before they expire, so that hot keys do not expire at once across all
+// processes (XFetch). A value is recomputed when
+//
+//	delta * beta * -ln(rand()) >= ttl
+//
+// where delta is how long the loader took to compute it, as stored with
+// the value, and ttl is its remaining TTL read with the meta get flag t.
+// The larger beta, the earlier the values are recomputed; 1 is a good
+// default. The cached value is returned if the early recompute fails.
+// Servers without the meta commands get no early recomputes.
+func WithEarlyRecompute(beta float64) LoadOption {
+	return func(o *loadOptions) {
+		o.beta = beta
+	}
+}
+
+// WithFlags sets the flags stored with the loaded values. They must not
+// overlap LoadFlagsReserved.
+func WithFlags(flags uint32) LoadOption {
+	return func(o *loadOptions) {
+		o.flags = flags
+	}
+}
+
+// GetOrLoad gets the value of key. On a cache miss the value is loaded
+// with loader and set with the ttl in seconds. Concurrent misses of the
+// same key in the process share a single loader call, which runs with the
+// ctx of the first caller; the others wait for it as long as their ctx
+// allows. The returned value is shared by them and must not be modified.
+//
+// If the cache fails, the value is loaded and returned anyway, without
+// setting it.
+func (c *Client) GetOrLoad(ctx context.Context, key string, ttl int32, loader func(ctx context.Context) ([]byte, error), opts ...LoadOption) ([]byte, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.flags&LoadFlagsReserved != 0 {
+		return nil, ErrReservedFlags
+	}
+
+	v, flags, remaining, err := c.lookup(ctx, key, o.beta > 0)
+	if err == nil {
+		if flags&loadFlagEntry == 0 {
+			return v, nil
+		}
+		delta := time.Duration(flags&loadFlagDuration>>loadDurationShift) * time.Millisecond
+		if !recomputeEarly(delta, remaining, o.beta) {
+			return v, nil
+		}
+		if nv, err := c.loads.do(ctx, key, func() ([]byte, error) {
+			return c.load(ctx, key, ttl, loader, o.flags, 0)
+		}); err == nil {
+			return nv, nil
+		}
+		return v, nil
+	}
+	if err == ErrMalformedKey {
+		return nil, err
+	}
+	if err != ErrCacheMiss {
+		return c.loads.do(ctx, key, func() ([]byte, error) {
+			return loader(ctx)
+		})
+	}
+
+	if o.negativeTTL > 0 {
+		if it, err := c.Get(ctx, loadErrorPrefix+key); err == nil {
+			return nil, &LoadError{Key: key, Msg: string(it.Value)}
+		}
+	}
+	return c.loads.do(ctx, key, func() ([]byte, error) {
+		return c.load(ctx, key, ttl, loader, o.flags, o.negativeTTL)
+	})
+}
+
+// lookup gets the value of key for GetOrLoad together with its flags and,
+// if withTTL, its remaining TTL, or -1 if it is not known.
+func (c *Client) lookup(ctx context.Context, key string, withTTL bool) (v []byte, flags uint32, ttl int64, err error) {
+	if withTTL {
+		mr, err := c.MetaGet(ctx, MetaGetOptions{Key: key, GetValue: true, GetFlags: true, GetTTL: true})
+		if err != ErrNotSupported {
+			return mr.Value, mr.Flags, mr.TTL, err
+		}
+	}
+	it, err := c.Get(ctx, key)
+	if err != nil {
+		return nil, 0, -1, err
+	}
+	return it.Value, it.Flags, -1, nil
+}
+
+// load loads the value of key and sets it with flags and the time the
+// loader took. Errors are cached for negativeTTL seconds if it is not zero,
+// under the key prefixed with loadErrorPrefix.
+func (c *Client) load(ctx context.Context, key string, ttl int32, loader func(ctx context.Context) ([]byte, error), flags uint32, negativeTTL int32) ([]byte, error) {
+	start := time.Now()
+	v, err := loader(ctx)
+	switch {
+	case err == nil:
+		d := uint32(time.Since(start) / time.Millisecond)
+		if d > loadDurationMaxMsec {
+			d = loadDurationMaxMsec
+		}
+		flags |= loadFlagEntry | d<<loadDurationShift
+		c.Set(ctx, &Item{Key: key, Value: v, Flags: flags, Expiration: ttl})
+	case negativeTTL > 0 && ctx.Err() == nil:
+		c.Set(ctx, &Item{Key: loadErrorPrefix + key, Value: []byte(err.Error()), Expiration: negativeTTL})
+	}
+	return v, err
+}
+
+// recomputeEarly reports whether a value computed in delta, which expires
+// in ttl seconds, is to be recomputed now. Values without TTL are not.
+func recomputeEarly(delta time.Duration, ttl int64, beta float64) bool {
+	if beta <= 0 || delta <= 0 || ttl < 0 {
+		return false
+	}
+	return delta.Seconds()*beta*-math.Log(loadRand()) >= float64(ttl)
+}
+
+// flightGroup runs a single call of a function per key at a time, the
+// callers coming while it runs share its result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	v    []byte
+	err  error
+}
+
+// do runs fn for key unless a call for key is running, in which case it
+// waits for its result or until ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.v, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	// The waiters get errLoaderPanic if fn panics.
+	f := &flight{done: make(chan struct{}), err: errLoaderPanic}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.v, f.err = fn()
+	return f.v, f.err
+}
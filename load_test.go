@@ -0,0 +1,223 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestClientGetOrLoad(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 100)
+	defer c.Close()
+
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrLoad(ctx, "load", 60, loader)
+			if err != nil || string(v) != "loaded" {
+				t.Errorf("GetOrLoad = %q, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("loader called %d times, want 1", calls)
+	}
+
+	if v, err := c.GetOrLoad(ctx, "load", 60, loader); err != nil || string(v) != "loaded" || calls != 1 {
+		t.Errorf("GetOrLoad of a cached value = %q, %v, %d loader calls", v, err, calls)
+	}
+	if it, err := c.Get(ctx, "load"); err != nil || string(it.Value) != "loaded" {
+		t.Errorf("Get = %+v, %v", it, err)
+	}
+
+	// A waiter gives up when its ctx is done.
+	block := make(chan struct{})
+	go c.GetOrLoad(ctx, "slow", 60, func(ctx context.Context) ([]byte, error) {
+		<-block
+		return []byte("slow"), nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetOrLoad(tctx, "slow", 60, loader); err != context.DeadlineExceeded {
+		t.Errorf("GetOrLoad of a waiter = %v", err)
+	}
+	close(block)
+}
+
+func TestClientGetOrLoadNegative(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+
+	var calls int
+	errNotFound := errors.New("not found")
+	loader := func(ctx context.Context) ([]byte, error) {
+		calls++
+		return nil, errNotFound
+	}
+
+	// Errors are not cached by default.
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOrLoad(ctx, "neg", 60, loader); err != errNotFound {
+			t.Errorf("GetOrLoad = %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("loader called %d times, want 2", calls)
+	}
+
+	if _, err := c.GetOrLoad(ctx, "neg", 60, loader, WithNegativeTTL(10)); err != errNotFound {
+		t.Errorf("GetOrLoad = %v", err)
+	}
+	_, err := c.GetOrLoad(ctx, "neg", 60, loader, WithNegativeTTL(10))
+	if le, ok := err.(*LoadError); !ok || le.Key != "neg" || le.Msg != "not found" {
+		t.Errorf("GetOrLoad of a cached error = %v", err)
+	}
+
+	// The cached error is not a value of the key.
+	if _, err := c.Get(ctx, "neg"); err != ErrCacheMiss {
+		t.Errorf("Get of a key with a cached error = %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("loader called %d times, want 3", calls)
+	}
+
+	s.Advance(11 * time.Second)
+	if _, err := c.GetOrLoad(ctx, "neg", 60, loader, WithNegativeTTL(10)); err != errNotFound || calls != 4 {
+		t.Errorf("GetOrLoad after the negative ttl = %v, %d loader calls", err, calls)
+	}
+}
+
+func TestClientGetOrLoadCacheDown(t *testing.T) {
+	s := memcachetest.NewServer()
+	addr := s.Addr()
+	s.Close()
+
+	c, _ := New(addr, 0, 10)
+	defer c.Close()
+
+	v, err := c.GetOrLoad(context.Background(), "down", 60, func(ctx context.Context) ([]byte, error) {
+		return []byte("fresh"), nil
+	})
+	if err != nil || string(v) != "fresh" {
+		t.Errorf("GetOrLoad without cache = %q, %v", v, err)
+	}
+}
+
+func TestClientGetOrLoadEarlyRecompute(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10)
+	defer c.Close()
+
+	defer func(f func() float64) { loadRand = f }(loadRand)
+	loadRand = func() float64 { return math.Exp(-10) }
+
+	var calls int
+	loader := func(ctx context.Context) ([]byte, error) {
+		calls++
+		return []byte("new"), nil
+	}
+
+	// The value took a second to compute: with beta 1 it is recomputed
+	// once it expires within 10 seconds.
+	c.Set(ctx, &Item{Key: "early", Value: []byte("old"), Flags: loadFlagEntry | 1000<<loadDurationShift, Expiration: 60})
+	if v, err := c.GetOrLoad(ctx, "early", 60, loader, WithEarlyRecompute(1)); err != nil || string(v) != "old" || calls != 0 {
+		t.Errorf("GetOrLoad long before expiry = %q, %v, %d loader calls", v, err, calls)
+	}
+	s.Advance(51 * time.Second)
+	if v, err := c.GetOrLoad(ctx, "early", 60, loader); err != nil || string(v) != "old" || calls != 0 {
+		t.Errorf("GetOrLoad without early recompute = %q, %v, %d loader calls", v, err, calls)
+	}
+	if v, err := c.GetOrLoad(ctx, "early", 60, loader, WithEarlyRecompute(1)); err != nil || string(v) != "new" || calls != 1 {
+		t.Errorf("GetOrLoad shortly before expiry = %q, %v, %d loader calls", v, err, calls)
+	}
+	mr, err := c.MetaGet(ctx, MetaGetOptions{Key: "early", GetValue: true, GetTTL: true})
+	if err != nil || string(mr.Value) != "new" || mr.TTL != 60 {
+		t.Errorf("MetaGet after the recompute = %+v, %v", mr, err)
+	}
+
+	// A failed early recompute returns the cached value.
+	c.Set(ctx, &Item{Key: "early", Value: []byte("old"), Flags: loadFlagEntry | 1000<<loadDurationShift, Expiration: 5})
+	v, err := c.GetOrLoad(ctx, "early", 60, func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("failed")
+	}, WithEarlyRecompute(1), WithNegativeTTL(10))
+	if err != nil || string(v) != "old" {
+		t.Errorf("GetOrLoad of a failed recompute = %q, %v", v, err)
+	}
+
+	// The time the loader took is stored with the value and the flags.
+	c.GetOrLoad(ctx, "timed", 60, func(ctx context.Context) ([]byte, error) {
+		time.Sleep(20 * time.Millisecond)
+		return []byte("v"), nil
+	}, WithFlags(7))
+	it, err := c.Get(ctx, "timed")
+	if err != nil || it.Flags&^LoadFlagsReserved != 7 || it.Flags&loadFlagEntry == 0 ||
+		it.Flags&loadFlagDuration>>loadDurationShift < 20 {
+		t.Errorf("Get = %+v, %v", it, err)
+	}
+	if _, err := c.GetOrLoad(ctx, "timed", 60, loader, WithFlags(1<<31)); err != ErrReservedFlags {
+		t.Errorf("GetOrLoad with reserved flags = %v", err)
+	}
+
+	// The flags of the items not written by GetOrLoad mean nothing to it.
+	calls = 0
+	c.Set(ctx, &Item{Key: "plain", Value: []byte("old"), Flags: 1<<30 | 1000, Expiration: 5})
+	if v, err := c.GetOrLoad(ctx, "plain", 60, loader, WithEarlyRecompute(1)); err != nil || string(v) != "old" || calls != 0 {
+		t.Errorf("GetOrLoad of a plain item = %q, %v, %d loader calls", v, err, calls)
+	}
+}
+
+func TestRecomputeEarly(t *testing.T) {
+	defer func(f func() float64) { loadRand = f }(loadRand)
+	loadRand = func() float64 { return math.Exp(-2) }
+
+	cases := []struct {
+		delta time.Duration
+		ttl   int64
+		beta  float64
+		want  bool
+	}{
+		{time.Second, 3, 1, false},
+		{time.Second, 2, 1.5, true},
+		{time.Second, 4, 2, true},
+		{time.Second, 0, 1, true},
+		{time.Second, -1, 1, false},
+		{0, 0, 1, false},
+		{time.Second, 1, 0, false},
+	}
+	for _, c := range cases {
+		if got := recomputeEarly(c.delta, c.ttl, c.beta); got != c.want {
+			t.Errorf("recomputeEarly(%v, %d, %v) = %v, want %v", c.delta, c.ttl, c.beta, got, c.want)
+		}
+	}
+}
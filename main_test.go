@@ -0,0 +1,32 @@
+package memcache
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+// TestMain runs the tests against the servers configured by MC_ADDRESS and
+// MC_SASL_ADDRESS, or against in-process fake servers if they are not set.
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	if os.Getenv("MC_ADDRESS") == "" {
+		s := memcachetest.NewServer()
+		defer s.Close()
+		os.Setenv("MC_ADDRESS", s.Addr())
+	}
+	if os.Getenv("MC_SASL_ADDRESS") == "" {
+		s := memcachetest.NewServer()
+		defer s.Close()
+		s.SetAuth("memcache", "secret")
+		os.Setenv("MC_SASL_ADDRESS", s.Addr())
+		os.Setenv("MC_SASL_USERNAME", "memcache")
+		os.Setenv("MC_SASL_PASSWORD", "secret")
+	}
+
+	return m.Run()
+}
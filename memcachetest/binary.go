@@ -0,0 +1,375 @@
+package memcachetest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+const (
+	binaryReqMagic = 0x80
+	binaryResMagic = 0x81
+	binaryHeader   = 24
+)
+
+const (
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opGetK       = 0x0c
+	opGetKQ      = 0x0d
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1a
+	opVerbosity  = 0x1b
+	opTouch      = 0x1c
+	opGAT        = 0x1d
+	opGATQ       = 0x1e
+	opSASLList   = 0x20
+	opSASLAuth   = 0x21
+	opSASLStep   = 0x22
+	opGATK       = 0x23
+	opGATKQ      = 0x24
+)
+
+const (
+	statusOK          = 0x00
+	statusNotFound    = 0x01
+	statusExists      = 0x02
+	statusInvalidArgs = 0x04
+	statusNotStored   = 0x05
+	statusNonNumeric  = 0x06
+	statusAuthError   = 0x20
+	statusUnknown     = 0x81
+)
+
+type binaryRequest struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+type binaryResponse struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+func readBinaryRequest(r io.Reader) (*binaryRequest, error) {
+	var h [binaryHeader]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0] != binaryReqMagic {
+		return nil, io.ErrUnexpectedEOF
+	}
+	keyLen := int(binary.BigEndian.Uint16(h[2:4]))
+	extLen := int(h[4])
+	body := make([]byte, binary.BigEndian.Uint32(h[8:12]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if extLen+keyLen > len(body) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &binaryRequest{
+		opcode: h[1],
+		opaque: binary.BigEndian.Uint32(h[12:16]),
+		cas:    binary.BigEndian.Uint64(h[16:24]),
+		extras: body[:extLen],
+		key:    string(body[extLen : extLen+keyLen]),
+		value:  body[extLen+keyLen:],
+	}, nil
+}
+
+func writeBinaryResponse(w io.Writer, req *binaryRequest, res *binaryResponse) {
+	var h [binaryHeader]byte
+	h[0] = binaryResMagic
+	h[1] = req.opcode
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(res.key)))
+	h[4] = byte(len(res.extras))
+	binary.BigEndian.PutUint16(h[6:8], res.status)
+	binary.BigEndian.PutUint32(h[8:12], uint32(len(res.extras)+len(res.key)+len(res.value)))
+	binary.BigEndian.PutUint32(h[12:16], req.opaque)
+	binary.BigEndian.PutUint64(h[16:24], res.cas)
+	w.Write(h[:])
+	w.Write(res.extras)
+	io.WriteString(w, res.key)
+	w.Write(res.value)
+}
+
+func quietOp(op byte) bool {
+	switch op {
+	case opGetQ, opGetKQ, opSetQ, opAddQ, opReplaceQ, opDeleteQ, opIncrementQ,
+		opDecrementQ, opQuitQ, opFlushQ, opAppendQ, opPrependQ, opGATQ, opGATKQ:
+		return true
+	}
+	return false
+}
+
+func (s *Server) serveBinary(rw *bufio.ReadWriter) {
+	s.mu.Lock()
+	authed := s.user == ""
+	s.mu.Unlock()
+
+	for {
+		req, err := readBinaryRequest(rw)
+		if err != nil {
+			rw.Flush()
+			return
+		}
+		if req.opcode == opQuit || req.opcode == opQuitQ {
+			if req.opcode == opQuit {
+				writeBinaryResponse(rw, req, &binaryResponse{})
+			}
+			rw.Flush()
+			return
+		}
+
+		var res *binaryResponse
+		switch {
+		case req.opcode == opSASLList:
+			res = &binaryResponse{value: []byte("PLAIN")}
+		case req.opcode == opSASLAuth || req.opcode == opSASLStep:
+			res, authed = s.saslAuth(req)
+		case !authed:
+			res = &binaryResponse{status: statusAuthError, value: []byte("Auth failure")}
+		case req.opcode == opStat:
+			s.binaryStats(rw, req)
+		default:
+			s.mu.Lock()
+			res = s.execBinary(req)
+			s.mu.Unlock()
+		}
+
+		if res != nil && !suppressed(req.opcode, res.status) {
+			writeBinaryResponse(rw, req, res)
+		}
+		if rw.Reader.Buffered() == 0 {
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// suppressed reports whether the response of a quiet command is omitted:
+// quiet gets only answer hits, the other quiet commands only answer errors.
+func suppressed(op byte, status uint16) bool {
+	if !quietOp(op) {
+		return false
+	}
+	switch op {
+	case opGetQ, opGetKQ, opGATQ, opGATKQ:
+		return status == statusNotFound
+	}
+	return status == statusOK
+}
+
+func (s *Server) saslAuth(req *binaryRequest) (*binaryResponse, bool) {
+	fail := &binaryResponse{status: statusAuthError, value: []byte("Auth failure")}
+	if req.key != "PLAIN" {
+		return fail, false
+	}
+	parts := bytes.Split(req.value, []byte{0})
+	if len(parts) != 3 {
+		return fail, false
+	}
+	s.mu.Lock()
+	ok := string(parts[1]) == s.user && string(parts[2]) == s.pass
+	s.mu.Unlock()
+	if !ok {
+		return fail, false
+	}
+	return &binaryResponse{value: []byte("Authenticated")}, true
+}
+
+func (s *Server) binaryStats(w io.Writer, req *binaryRequest) {
+	if statsDetail(req.key) {
+		writeBinaryResponse(w, req, &binaryResponse{})
+		return
+	}
+	s.mu.Lock()
+	stats, ok := s.stats(req.key)
+	s.mu.Unlock()
+	if !ok {
+		writeBinaryResponse(w, req, &binaryResponse{status: statusNotFound})
+		return
+	}
+	for _, kv := range stats {
+		writeBinaryResponse(w, req, &binaryResponse{key: kv[0], value: []byte(kv[1])})
+	}
+	writeBinaryResponse(w, req, &binaryResponse{})
+}
+
+func (s *Server) execBinary(req *binaryRequest) *binaryResponse {
+	switch req.opcode {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ:
+		it := s.lookup(req.key)
+		s.count("cmd_get")
+		s.hit("get", it != nil)
+		switch req.opcode {
+		case opGAT, opGATQ, opGATK, opGATKQ:
+			s.count("cmd_touch")
+			s.hit("touch", it != nil)
+		}
+		if it == nil {
+			return &binaryResponse{status: statusNotFound, value: []byte("Not found")}
+		}
+		switch req.opcode {
+		case opGAT, opGATQ, opGATK, opGATKQ:
+			if len(req.extras) != 4 {
+				return &binaryResponse{status: statusInvalidArgs}
+			}
+			it.exptime = s.exptime(int64(int32(binary.BigEndian.Uint32(req.extras))))
+		}
+		it.fetched = true
+		it.atime = s.unix()
+		res := &binaryResponse{cas: it.cas, extras: make([]byte, 4), value: it.value}
+		binary.BigEndian.PutUint32(res.extras, it.flags)
+		switch req.opcode {
+		case opGetK, opGetKQ, opGATK, opGATKQ:
+			res.key = req.key
+		}
+		return res
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		if len(req.extras) != 8 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		flags := binary.BigEndian.Uint32(req.extras[0:4])
+		exp := int64(int32(binary.BigEndian.Uint32(req.extras[4:8])))
+		verb := "set"
+		switch req.opcode {
+		case opAdd, opAddQ:
+			verb = "add"
+		case opReplace, opReplaceQ:
+			verb = "replace"
+		}
+		if req.cas != 0 {
+			old := s.lookup(req.key)
+			if old == nil {
+				return &binaryResponse{status: statusNotFound}
+			}
+			if old.cas != req.cas {
+				return &binaryResponse{status: statusExists}
+			}
+		}
+		return s.binaryStoreResult(verb, req.key, s.set(verb, req.key, flags, exp, 0, req.value))
+	case opAppend, opAppendQ, opPrepend, opPrependQ:
+		verb := "append"
+		if req.opcode == opPrepend || req.opcode == opPrependQ {
+			verb = "prepend"
+		}
+		return s.binaryStoreResult(verb, req.key, s.set(verb, req.key, 0, 0, 0, req.value))
+	case opDelete, opDeleteQ:
+		it := s.lookup(req.key)
+		s.hit("delete", it != nil)
+		if it == nil {
+			return &binaryResponse{status: statusNotFound}
+		}
+		if req.cas != 0 && req.cas != it.cas {
+			return &binaryResponse{status: statusExists}
+		}
+		delete(s.items, req.key)
+		return &binaryResponse{}
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		if len(req.extras) != 20 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		delta := binary.BigEndian.Uint64(req.extras[0:8])
+		initial := binary.BigEndian.Uint64(req.extras[8:16])
+		exp := binary.BigEndian.Uint32(req.extras[16:20])
+		incr := req.opcode == opIncrement || req.opcode == opIncrementQ
+		v, res, ok := s.incrDecr(req.key, incr, delta)
+		if !ok {
+			return &binaryResponse{status: statusNonNumeric}
+		}
+		if res == notFound {
+			if exp == 0xffffffff {
+				return &binaryResponse{status: statusNotFound}
+			}
+			v = initial
+			s.store(req.key, &item{value: []byte(strconv.FormatUint(v, 10)), exptime: s.exptime(int64(exp))})
+		}
+		out := &binaryResponse{cas: s.items[req.key].cas, value: make([]byte, 8)}
+		binary.BigEndian.PutUint64(out.value, v)
+		return out
+	case opTouch:
+		if len(req.extras) != 4 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		it := s.lookup(req.key)
+		s.count("cmd_touch")
+		s.hit("touch", it != nil)
+		if it == nil {
+			return &binaryResponse{status: statusNotFound}
+		}
+		it.exptime = s.exptime(int64(int32(binary.BigEndian.Uint32(req.extras))))
+		return &binaryResponse{cas: it.cas}
+	case opFlush, opFlushQ:
+		var delay int64
+		if len(req.extras) == 4 {
+			delay = int64(binary.BigEndian.Uint32(req.extras))
+		}
+		s.flush(delay)
+		return &binaryResponse{}
+	case opNoop:
+		return &binaryResponse{}
+	case opVerbosity:
+		if len(req.extras) != 4 {
+			return &binaryResponse{status: statusInvalidArgs}
+		}
+		s.verbosity = int(binary.BigEndian.Uint32(req.extras))
+		return &binaryResponse{}
+	case opVersion:
+		return &binaryResponse{value: []byte(s.version)}
+	}
+	return &binaryResponse{status: statusUnknown, value: []byte("Unknown command")}
+}
+
+// binaryStoreResult converts the result of a storage command. Like
+// memcached, a failed add is reported as an existing key and a failed
+// replace as a missing key.
+func (s *Server) binaryStoreResult(verb, key string, r storeResult) *binaryResponse {
+	switch {
+	case r == notStored && verb == "add":
+		return &binaryResponse{status: statusExists}
+	case r == notStored && verb == "replace":
+		return &binaryResponse{status: statusNotFound}
+	}
+	switch r {
+	case notStored:
+		return &binaryResponse{status: statusNotStored}
+	case exists:
+		return &binaryResponse{status: statusExists}
+	case notFound:
+		return &binaryResponse{status: statusNotFound}
+	}
+	return &binaryResponse{cas: s.items[key].cas}
+}
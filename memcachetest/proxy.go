@@ -0,0 +1,373 @@
+package memcachetest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault is a failure injected by a Proxy.
+type Fault int
+
+const (
+	// NoFault forwards requests and responses unchanged.
+	NoFault Fault = iota
+	// Drop forwards the first half of the next response line and closes
+	// the connection.
+	Drop
+	// Truncate forwards value blocks only partially and closes the
+	// connection. Only the text protocol is understood.
+	Truncate
+	// OutOfMemory answers every command with SERVER_ERROR out of memory
+	// without forwarding it. Only the text protocol is understood.
+	OutOfMemory
+	// Blackhole discards requests. No response is ever sent.
+	Blackhole
+)
+
+// Proxy forwards connections to a server and injects faults on demand.
+// Faults apply to all connections, established or new, until they are
+// changed.
+type Proxy struct {
+	ln     net.Listener
+	target string
+
+	mu       sync.Mutex
+	fault    Fault
+	latency  time.Duration
+	accepted int
+	conns    map[net.Conn]struct{}
+	closed   bool
+
+	wg sync.WaitGroup
+}
+
+// NewProxy starts a proxy forwarding the connections it accepts on a
+// random port of the loopback interface to target. It panics if no port
+// can be listened on. The caller should call Close when finished.
+func NewProxy(target string) *Proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("memcachetest: failed to listen on a port: " + err.Error())
+	}
+	p := &Proxy{
+		ln:     ln,
+		target: target,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p
+}
+
+// Addr returns the address the proxy listens on.
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Close stops the proxy and closes all connections.
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	p.closed = true
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.ln.Close()
+	p.wg.Wait()
+}
+
+// SetFault injects f into all connections. NoFault stops injecting.
+func (p *Proxy) SetFault(f Fault) {
+	p.mu.Lock()
+	p.fault = f
+	p.mu.Unlock()
+}
+
+// SetLatency delays every request forwarded to the server by d.
+func (p *Proxy) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	p.latency = d
+	p.mu.Unlock()
+}
+
+// Accepted returns the number of connections accepted so far.
+func (p *Proxy) Accepted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+func (p *Proxy) state() (Fault, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fault, p.latency
+}
+
+// track registers c to be closed with the proxy. It returns false if the
+// proxy is already closed.
+func (p *Proxy) track(c net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(c net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+	c.Close()
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !p.track(c) {
+			c.Close()
+			return
+		}
+		p.mu.Lock()
+		p.accepted++
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.untrack(c)
+			p.handle(c)
+		}()
+	}
+}
+
+// proxyConn is a proxied connection. Both directions write to the client,
+// so the writes are serialized.
+type proxyConn struct {
+	client net.Conn
+	server net.Conn
+	mu     sync.Mutex
+	w      *bufio.Writer
+	once   sync.Once
+}
+
+func (pc *proxyConn) write(b ...[]byte) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, b := range b {
+		pc.w.Write(b)
+	}
+	return pc.w.Flush()
+}
+
+func (pc *proxyConn) close() {
+	pc.once.Do(func() {
+		pc.client.Close()
+		pc.server.Close()
+	})
+}
+
+func (p *Proxy) handle(c net.Conn) {
+	s, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	if !p.track(s) {
+		s.Close()
+		return
+	}
+	defer p.untrack(s)
+
+	pc := &proxyConn{client: c, server: s, w: bufio.NewWriter(c)}
+	defer pc.close()
+
+	r := bufio.NewReader(c)
+	b, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	binary := b[0] == binaryReqMagic
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer pc.close()
+		p.forwardResponses(pc, binary)
+	}()
+	p.forwardRequests(pc, r, binary)
+	pc.close()
+	<-done
+}
+
+// forwardRequests copies requests from the client to the server.
+func (p *Proxy) forwardRequests(pc *proxyConn, r *bufio.Reader, binary bool) {
+	w := bufio.NewWriter(pc.server)
+	batch := true
+	for {
+		if batch || r.Buffered() == 0 {
+			// A new batch of requests, delay it as a whole.
+			if _, err := r.Peek(1); err != nil {
+				return
+			}
+			if _, latency := p.state(); latency > 0 {
+				time.Sleep(latency)
+			}
+			batch = false
+		}
+
+		fault, _ := p.state()
+		if binary {
+			b := make([]byte, r.Buffered())
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			if fault == Blackhole {
+				continue
+			}
+			w.Write(b)
+		} else {
+			line, data, err := readRequest(r)
+			if err != nil {
+				return
+			}
+			switch fault {
+			case Blackhole:
+				continue
+			case OutOfMemory:
+				if err := pc.write([]byte(outOfMemory(line))); err != nil {
+					return
+				}
+				continue
+			}
+			w.WriteString(line)
+			w.Write(data)
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// outOfMemory returns the response of memcached running out of memory.
+func outOfMemory(line string) string {
+	if strings.HasPrefix(line, "mn") {
+		return "MN\r\n"
+	}
+	return "SERVER_ERROR out of memory\r\n"
+}
+
+// readRequest reads a text protocol command line and its data block.
+func readRequest(r *bufio.Reader) (string, []byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return line, nil, nil
+	}
+
+	size := -1
+	switch fields[0] {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(fields) > 4 {
+			size, _ = strconv.Atoi(fields[4])
+		}
+	case "ms":
+		if len(fields) > 2 {
+			size, _ = strconv.Atoi(fields[2])
+		}
+	}
+	if size < 0 {
+		return line, nil, nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, err
+	}
+	return line, data, nil
+}
+
+// forwardResponses copies responses from the server to the client.
+func (p *Proxy) forwardResponses(pc *proxyConn, binary bool) {
+	r := bufio.NewReader(pc.server)
+	for {
+		if binary {
+			if _, err := r.Peek(1); err != nil {
+				return
+			}
+			b := make([]byte, r.Buffered())
+			io.ReadFull(r, b)
+			if fault, _ := p.state(); fault == Drop {
+				pc.write(b[:len(b)/2])
+				return
+			}
+			if err := pc.write(b); err != nil {
+				return
+			}
+			continue
+		}
+
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		fault, _ := p.state()
+		if fault == Drop {
+			pc.write(line[:len(line)/2])
+			return
+		}
+
+		size := valueSize(line)
+		if size < 0 {
+			if err := pc.write(line); err != nil {
+				return
+			}
+			continue
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		if fault == Truncate {
+			pc.write(line, data[:size/2])
+			return
+		}
+		if err := pc.write(line, data); err != nil {
+			return
+		}
+	}
+}
+
+// valueSize returns the size of the value block following a response line,
+// or -1 if no value follows.
+func valueSize(line []byte) int {
+	fields := strings.Fields(string(line))
+	i := -1
+	switch {
+	case len(fields) >= 4 && fields[0] == "VALUE":
+		i = 3
+	case len(fields) >= 2 && fields[0] == "VA":
+		i = 1
+	default:
+		return -1
+	}
+	n, err := strconv.Atoi(fields[i])
+	if err != nil {
+		return -1
+	}
+	return n
+}
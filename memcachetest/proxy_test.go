@@ -0,0 +1,84 @@
+package memcachetest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func dialProxy(t *testing.T, p *Proxy) *client {
+	nc, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClient(t, nc)
+}
+
+// expectClosed checks that req is answered with the partial response want
+// followed by the end of the connection.
+func (c *client) expectClosed(req, want string) {
+	c.t.Helper()
+	io.WriteString(c.nc, req)
+	b, err := ioutil.ReadAll(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if string(b) != want {
+		c.t.Errorf("%q: got %q, want %q", req, b, want)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	p := NewProxy(s.Addr())
+	defer p.Close()
+
+	c := dialProxy(t, p)
+	c.expect("set foo 0 0 6\r\nfoobar\r\n", "STORED")
+	c.expect("get foo\r\n", "VALUE foo 0 6", "foobar", "END")
+
+	p.SetFault(OutOfMemory)
+	c.expect("set foo 0 0 1\r\nx\r\nmn\r\n", "SERVER_ERROR out of memory", "MN")
+	p.SetFault(NoFault)
+	c.expect("mg foo v\r\n", "VA 6", "foobar")
+
+	p.SetFault(Truncate)
+	c.expectClosed("mg foo v\r\n", "VA 6\r\nfoo")
+	c = dialProxy(t, p)
+	c.expectClosed("get foo\r\n", "VALUE foo 0 6\r\nfoo")
+
+	p.SetFault(Drop)
+	c = dialProxy(t, p)
+	line := "VERSION " + Version + "\r\n"
+	c.expectClosed("version\r\n", line[:len(line)/2])
+
+	if n := p.Accepted(); n != 3 {
+		t.Errorf("Accepted = %d, want 3", n)
+	}
+}
+
+func TestProxyDelay(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	p := NewProxy(s.Addr())
+	defer p.Close()
+
+	c := dialProxy(t, p)
+	p.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	c.expect("version\r\n", "VERSION "+Version)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("response after %v, want latency", d)
+	}
+
+	p.SetLatency(0)
+	p.SetFault(Blackhole)
+	c.nc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	io.WriteString(c.nc, "version\r\n")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("blackholed request answered")
+	}
+}
@@ -0,0 +1,331 @@
+// Package memcachetest provides an in-process memcached server for tests.
+//
+// The server speaks the text protocol, the meta commands and the binary
+// protocol (including SASL PLAIN) on a local TCP listener and keeps its
+// items in memory. Its clock can be moved forward with Advance so that
+// expiration can be tested without sleeping.
+package memcachetest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Version is the version reported by the server unless changed with
+// SetVersion.
+const Version = "1.6.21"
+
+type item struct {
+	value   []byte
+	flags   uint32
+	exptime int64 // unix seconds, 0 means never
+	cas     uint64
+	atime   int64
+	fetched bool
+	stale   bool
+	won     bool // a win token has been handed out
+}
+
+// Server is a fake memcached server.
+type Server struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	items   map[string]*item
+	cas     uint64
+	offset  time.Duration
+	flushAt int64
+	user    string
+	pass    string
+	started time.Time
+	conns   map[net.Conn]int // connection ids
+	connID  int
+	closed  bool
+	counts  map[string]uint64
+
+	maxBytes  int
+	verbosity int
+	shutdown  bool
+	version   string
+	meta      bool
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server listening on a random port of the loopback
+// interface. It panics if no port can be listened on. The caller should
+// call Close when finished, to shut it down.
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("memcachetest: failed to listen on a port: " + err.Error())
+	}
+	return NewServerListener(ln)
+}
+
+// NewServerListener starts a server accepting connections from ln.
+func NewServerListener(ln net.Listener) *Server {
+	s := &Server{
+		ln:      ln,
+		items:   make(map[string]*item),
+		started: time.Now(),
+		conns:   make(map[net.Conn]int),
+		counts:  make(map[string]uint64),
+
+		maxBytes: 64 << 20,
+		version:  Version,
+		meta:     true,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes all client connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+// Advance moves the server clock forward by d.
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	s.offset += d
+	s.mu.Unlock()
+}
+
+// Now returns the current time of the server clock.
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now()
+}
+
+// SetAuth requires binary protocol clients to authenticate with SASL PLAIN
+// using the given credentials before issuing any other command.
+func (s *Server) SetAuth(username, password string) {
+	s.mu.Lock()
+	s.user, s.pass = username, password
+	s.mu.Unlock()
+}
+
+// EnableShutdown makes the server stop on the shutdown command, like
+// memcached -A. Otherwise the command is refused.
+func (s *Server) EnableShutdown() {
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+}
+
+// SetVersion makes the server report version v. Servers older than 1.6.0
+// do not know the meta commands and answer them with ERROR.
+func (s *Server) SetVersion(v string) {
+	var major, minor int
+	fmt.Sscanf(v, "%d.%d", &major, &minor)
+	s.mu.Lock()
+	s.version = v
+	s.meta = major > 1 || major == 1 && minor >= 6
+	s.mu.Unlock()
+}
+
+// Len returns the number of live items.
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := s.usage()
+	return n
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+func (s *Server) unix() int64 {
+	return s.now().Unix()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.connID++
+		s.conns[c] = s.connID
+		s.count("total_connections")
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	b, err := rw.Reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if b[0] == binaryReqMagic {
+		s.serveBinary(rw)
+		return
+	}
+	s.serveText(rw)
+}
+
+// exptime converts a memcached expiration into an absolute unix time.
+func (s *Server) exptime(exp int64) int64 {
+	switch {
+	case exp == 0:
+		return 0
+	case exp < 0:
+		return s.unix() - 1
+	case exp > 60*60*24*30:
+		return exp
+	}
+	return s.unix() + exp
+}
+
+// lookup returns the live item stored under key. s.mu must be held.
+func (s *Server) lookup(key string) *item {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	now := s.unix()
+	if (it.exptime != 0 && it.exptime <= now) || (s.flushAt != 0 && s.flushAt <= now && it.atime <= s.flushAt) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+// store saves it under key with a fresh CAS value. s.mu must be held.
+func (s *Server) store(key string, it *item) {
+	s.cas++
+	it.cas = s.cas
+	it.atime = s.unix()
+	s.items[key] = it
+}
+
+func (s *Server) nextCAS() uint64 {
+	s.cas++
+	return s.cas
+}
+
+func (s *Server) flush(delay int64) {
+	s.count("cmd_flush")
+	if delay <= 0 {
+		s.items = make(map[string]*item)
+		s.flushAt = 0
+		return
+	}
+	s.flushAt = s.exptime(delay)
+}
+
+type storeResult int
+
+const (
+	stored storeResult = iota
+	notStored
+	exists
+	notFound
+)
+
+// set implements the classic storage commands. s.mu must be held.
+func (s *Server) set(verb, key string, flags uint32, exp int64, cas uint64, value []byte) storeResult {
+	old := s.lookup(key)
+	s.count("cmd_set")
+	switch verb {
+	case "add":
+		if old != nil {
+			old.atime = s.unix()
+			return notStored
+		}
+	case "replace":
+		if old == nil {
+			return notStored
+		}
+	case "append", "prepend":
+		if old == nil {
+			return notStored
+		}
+		v := make([]byte, 0, len(old.value)+len(value))
+		if verb == "append" {
+			v = append(append(v, old.value...), value...)
+		} else {
+			v = append(append(v, value...), old.value...)
+		}
+		old.value = v
+		old.cas = s.nextCAS()
+		return stored
+	case "cas":
+		if old == nil {
+			s.count("cas_misses")
+			return notFound
+		}
+		if old.cas != cas {
+			s.count("cas_badval")
+			return exists
+		}
+		s.count("cas_hits")
+	}
+	s.store(key, &item{value: value, flags: flags, exptime: s.exptime(exp)})
+	return stored
+}
+
+func (s *Server) incrDecr(key string, incr bool, delta uint64) (uint64, storeResult, bool) {
+	it := s.lookup(key)
+	if incr {
+		s.hit("incr", it != nil)
+	} else {
+		s.hit("decr", it != nil)
+	}
+	if it == nil {
+		return 0, notFound, true
+	}
+	v, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		return 0, notStored, false
+	}
+	if incr {
+		v += delta
+	} else if delta > v {
+		v = 0
+	} else {
+		v -= delta
+	}
+	it.value = []byte(strconv.FormatUint(v, 10))
+	it.cas = s.nextCAS()
+	it.atime = s.unix()
+	return v, stored, true
+}
@@ -0,0 +1,204 @@
+package memcachetest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type client struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func newClient(t *testing.T, nc net.Conn) *client {
+	return &client{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+func dial(t *testing.T, s *Server) *client {
+	nc, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClient(t, nc)
+}
+
+// expect sends req and checks that the next response lines are want.
+func (c *client) expect(req string, want ...string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.nc, req); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, w := range want {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if line = strings.TrimSuffix(line, "\r\n"); line != w {
+			c.t.Errorf("%q: got %q, want %q", req, line, w)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+
+	c.expect("get foo\r\n", "END")
+	c.expect("set foo 3 0 3\r\nbar\r\n", "STORED")
+	c.expect("get foo\r\n", "VALUE foo 3 3", "bar", "END")
+	c.expect("add foo 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.expect("append foo 0 0 1\r\nx\r\n", "STORED")
+	c.expect("gets foo\r\n", "VALUE foo 3 4 2", "barx", "END")
+	c.expect("cas foo 0 0 1 1\r\nx\r\n", "EXISTS")
+	c.expect("cas foo 0 0 1 2\r\nx\r\n", "STORED")
+	c.expect("incr foo 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	c.expect("set n 0 0 2\r\n10\r\n", "STORED")
+	c.expect("incr n 5\r\n", "15")
+	c.expect("decr n 20\r\n", "0")
+	c.expect("delete n noreply\r\ndelete n\r\n", "NOT_FOUND")
+	c.expect("version\r\n", "VERSION "+Version)
+	c.expect("flush_all\r\n", "OK")
+	c.expect("get foo\r\n", "END")
+	c.expect("bogus\r\n", "ERROR")
+	if s.Len() != 0 {
+		t.Errorf("Len = %d after flush_all", s.Len())
+	}
+}
+
+func TestClock(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+
+	c.expect("set foo 0 10 3\r\nbar\r\n", "STORED")
+	c.expect("mg foo t\r\n", "HD t10")
+	s.Advance(9 * time.Second)
+	c.expect("mg foo t\r\n", "HD t1")
+	s.Advance(time.Second)
+	c.expect("get foo\r\n", "END")
+
+	c.expect("set foo 0 0 3\r\nbar\r\n", "STORED")
+	c.expect("flush_all 5\r\n", "OK")
+	c.expect("mg foo v\r\n", "VA 3", "bar")
+	s.Advance(5 * time.Second)
+	c.expect("mg foo v\r\n", "EN")
+}
+
+func TestMeta(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+
+	c.expect("ms foo 3 T0 F5 c\r\nbar\r\n", "HD c1")
+	c.expect("mg foo s f v k O9\r\n", "VA 3 kfoo O9 s3 f5", "bar")
+	c.expect("mg Zm9v b k v\r\n", "VA 3 b kZm9v", "bar")
+	c.expect("ms foo 1 C9\r\nx\r\n", "EX")
+	c.expect("ms foo 1 ME\r\nx\r\n", "NS")
+	c.expect("ms foo 1 MA\r\nx\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 4", "barx")
+	c.expect("mg missing v q\r\nmn\r\n", "MN")
+	c.expect("md missing\r\n", "NF")
+	c.expect("ma n\r\n", "NF")
+	c.expect("ma n N0 J10 v\r\n", "VA 2", "10")
+	c.expect("ma n MD D3 v\r\n", "VA 1", "7")
+	c.expect("md foo\r\n", "HD")
+	c.expect("mg foo\r\n", "EN")
+}
+
+func TestMetaStaleWin(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+
+	// Vivify on miss: the first client wins, the others see the token taken.
+	c.expect("mg foo N30 c v\r\n", "VA 0 c1 W", "")
+	c.expect("mg foo c v\r\n", "VA 0 c1 Z", "")
+	c.expect("ms foo 3 C1 T60\r\nbar\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 3", "bar")
+
+	// Recache: a TTL below the R threshold hands out one win token.
+	c.expect("mg foo R120 v\r\n", "VA 3 W", "bar")
+	c.expect("mg foo R120 v\r\n", "VA 3 Z", "bar")
+
+	// Invalidation marks the item stale instead of removing it.
+	c.expect("ms foo 3\r\nbar\r\n", "HD")
+	c.expect("md foo I T30\r\n", "HD")
+	c.expect("mg foo c v\r\n", "VA 3 c4 W X", "bar")
+	c.expect("mg foo v\r\n", "VA 3 X Z", "bar")
+	// A stale CAS is accepted with I and keeps the item stale.
+	c.expect("ms foo 3 C3 I\r\nbaz\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 3 W X", "baz")
+	c.expect("ms foo 3\r\nqux\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 3", "qux")
+}
+
+func TestBinarySASL(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetAuth("user", "pass")
+
+	status := func(nc net.Conn, op byte, key, value string) uint16 {
+		var h [binaryHeader]byte
+		h[0] = binaryReqMagic
+		h[1] = op
+		binary.BigEndian.PutUint16(h[2:4], uint16(len(key)))
+		binary.BigEndian.PutUint32(h[8:12], uint32(len(key)+len(value)))
+		nc.Write(append(append(h[:], key...), value...))
+
+		if _, err := io.ReadFull(nc, h[:]); err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, binary.BigEndian.Uint32(h[8:12]))
+		if _, err := io.ReadFull(nc, body); err != nil {
+			t.Fatal(err)
+		}
+		return binary.BigEndian.Uint16(h[6:8])
+	}
+
+	nc, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	if st := status(nc, opGet, "foo", ""); st != statusAuthError {
+		t.Errorf("get before auth: status %#x", st)
+	}
+	if st := status(nc, opSASLAuth, "PLAIN", "\x00user\x00wrong"); st != statusAuthError {
+		t.Errorf("auth with wrong password: status %#x", st)
+	}
+	if st := status(nc, opSASLAuth, "PLAIN", "\x00user\x00pass"); st != statusOK {
+		t.Errorf("auth: status %#x", st)
+	}
+	if st := status(nc, opGet, "foo", ""); st != statusNotFound {
+		t.Errorf("get after auth: status %#x", st)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+
+	c.expect("set foo 0 0 3\r\nbar\r\n", "STORED")
+	c.expect("get foo bar\r\n", "VALUE foo 0 3", "bar", "END")
+	if s.Stat("get_hits") != 1 || s.Stat("get_misses") != 1 || s.Stat("cmd_set") != 1 {
+		t.Errorf("counters: get_hits %d, get_misses %d, cmd_set %d",
+			s.Stat("get_hits"), s.Stat("get_misses"), s.Stat("cmd_set"))
+	}
+	c.expect("stats items\r\n",
+		"STAT items:1:number 1",
+		"STAT items:1:age 0",
+		"STAT items:1:evicted 0",
+		"STAT items:1:outofmemory 0",
+		"STAT items:1:mem_requested 6",
+		"END")
+	c.expect("stats bogus\r\n", "ERROR")
+}
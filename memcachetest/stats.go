@@ -0,0 +1,185 @@
+package memcachetest
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const chunkSize = 96
+
+// count increments the counter reported as the statistic name. s.mu must
+// be held.
+func (s *Server) count(name string) {
+	s.counts[name]++
+}
+
+// hit counts a hit or a miss of cmd. s.mu must be held.
+func (s *Server) hit(cmd string, ok bool) {
+	if ok {
+		s.count(cmd + "_hits")
+	} else {
+		s.count(cmd + "_misses")
+	}
+}
+
+// Stat returns the current value of the counter reported as the general
+// statistic name, e.g. get_hits or cmd_set.
+func (s *Server) Stat(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[name]
+}
+
+// stats returns the statistics reported for the given group. It returns
+// false if the group is unknown. s.mu must be held.
+func (s *Server) stats(group string) ([][2]string, bool) {
+	switch group {
+	case "":
+		return s.generalStats(), true
+	case "settings":
+		return [][2]string{
+			{"maxbytes", strconv.Itoa(s.maxBytes)},
+			{"maxconns", "1024"},
+			{"tcpport", "11211"},
+			{"verbosity", strconv.Itoa(s.verbosity)},
+			{"evictions", "on"},
+			{"growth_factor", "1.25"},
+			{"chunk_size", "48"},
+			{"num_threads", "4"},
+			{"cas_enabled", "yes"},
+			{"item_size_max", "1048576"},
+		}, true
+	case "slabs":
+		n, size := s.usage()
+		if n == 0 {
+			return [][2]string{{"active_slabs", "0"}, {"total_malloced", "0"}}, true
+		}
+		perPage := 1 << 20 / chunkSize
+		pages := (n + perPage - 1) / perPage
+		return [][2]string{
+			{"1:chunk_size", strconv.Itoa(chunkSize)},
+			{"1:chunks_per_page", strconv.Itoa(perPage)},
+			{"1:total_pages", strconv.Itoa(pages)},
+			{"1:total_chunks", strconv.Itoa(pages * perPage)},
+			{"1:used_chunks", strconv.Itoa(n)},
+			{"1:free_chunks", strconv.Itoa(pages*perPage - n)},
+			{"1:mem_requested", strconv.Itoa(size)},
+			{"1:get_hits", s.counter("get_hits")},
+			{"1:cmd_set", s.counter("cmd_set")},
+			{"active_slabs", "1"},
+			{"total_malloced", strconv.Itoa(pages << 20)},
+		}, true
+	case "items":
+		n, size := s.usage()
+		if n == 0 {
+			return nil, true
+		}
+		return [][2]string{
+			{"items:1:number", strconv.Itoa(n)},
+			{"items:1:age", strconv.FormatInt(s.oldest(), 10)},
+			{"items:1:evicted", "0"},
+			{"items:1:outofmemory", "0"},
+			{"items:1:mem_requested", strconv.Itoa(size)},
+		}, true
+	case "conns":
+		ids := make([]int, 0, len(s.conns))
+		addrs := make(map[int]string, len(s.conns))
+		for c, id := range s.conns {
+			ids = append(ids, id)
+			addrs[id] = c.RemoteAddr().String()
+		}
+		sort.Ints(ids)
+		var stats [][2]string
+		for _, id := range ids {
+			p := strconv.Itoa(id) + ":"
+			stats = append(stats,
+				[2]string{p + "addr", "tcp:" + addrs[id]},
+				[2]string{p + "listen_addr", "tcp:" + s.ln.Addr().String()},
+				[2]string{p + "state", "conn_parse_cmd"},
+				[2]string{p + "secs_since_last_cmd", "0"},
+			)
+		}
+		return stats, true
+	}
+	return nil, false
+}
+
+func (s *Server) generalStats() [][2]string {
+	n, size := s.usage()
+	stats := [][2]string{
+		{"pid", "1"},
+		{"uptime", strconv.FormatInt(int64(s.now().Sub(s.started).Seconds()), 10)},
+		{"time", strconv.FormatInt(s.unix(), 10)},
+		{"version", s.version},
+		{"pointer_size", "64"},
+		{"curr_connections", strconv.Itoa(len(s.conns))},
+		{"total_connections", s.counter("total_connections")},
+		{"curr_items", strconv.Itoa(n)},
+		{"total_items", s.counter("cmd_set")},
+		{"bytes", strconv.Itoa(size)},
+		{"limit_maxbytes", strconv.Itoa(s.maxBytes)},
+		{"threads", "4"},
+		{"evictions", "0"},
+	}
+	for _, name := range []string{
+		"cmd_get", "cmd_set", "cmd_flush", "cmd_touch",
+		"get_hits", "get_misses", "delete_hits", "delete_misses",
+		"incr_hits", "incr_misses", "decr_hits", "decr_misses",
+		"cas_hits", "cas_misses", "cas_badval", "touch_hits", "touch_misses",
+	} {
+		stats = append(stats, [2]string{name, s.counter(name)})
+	}
+	return stats
+}
+
+func (s *Server) counter(name string) string {
+	return strconv.FormatUint(s.counts[name], 10)
+}
+
+// usage returns the number of live items and the bytes they use.
+func (s *Server) usage() (n, size int) {
+	for k := range s.items {
+		if it := s.lookup(k); it != nil {
+			n++
+			size += len(k) + len(it.value)
+		}
+	}
+	return
+}
+
+// oldest returns the age in seconds of the least recently accessed item.
+func (s *Server) oldest() int64 {
+	var age int64
+	for _, it := range s.items {
+		if a := s.unix() - it.atime; a > age {
+			age = a
+		}
+	}
+	return age
+}
+
+// statsDetail reports whether group turns the detailed stats on or off,
+// which the fake server accepts without keeping them.
+func statsDetail(group string) bool {
+	return group == "detail on" || group == "detail off"
+}
+
+func (s *Server) textStats(w io.Writer, args []string) bool {
+	group := ""
+	if len(args) > 0 {
+		group = args[0]
+	}
+	if statsDetail(strings.Join(args, " ")) {
+		return reply(w, false, "OK")
+	}
+	stats, ok := s.stats(group)
+	if !ok {
+		return reply(w, false, "ERROR")
+	}
+	for _, kv := range stats {
+		reply(w, false, "STAT "+kv[0]+" "+kv[1])
+	}
+	return reply(w, false, "END")
+}
@@ -0,0 +1,587 @@
+package memcachetest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const maxKeyLen = 250
+
+func (s *Server) serveText(rw *bufio.ReadWriter) {
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			io.WriteString(rw, "ERROR\r\n")
+		} else if !s.dispatchText(rw, fields) {
+			rw.Flush()
+			return
+		}
+		if rw.Reader.Buffered() == 0 {
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dispatchText executes one text protocol command. It returns false when the
+// connection should be closed.
+func (s *Server) dispatchText(rw *bufio.ReadWriter, fields []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.meta && len(fields[0]) == 2 && fields[0][0] == 'm' {
+		// Servers older than 1.6.0 do not know the meta commands.
+		return reply(rw, false, "ERROR")
+	}
+
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "get", "gets":
+		return s.textGet(rw, args, cmd == "gets")
+	case "gat", "gats":
+		if len(args) < 2 {
+			return clientError(rw, "bad command line format")
+		}
+		exp, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return clientError(rw, "invalid exptime argument")
+		}
+		for _, k := range args[1:] {
+			it := s.lookup(k)
+			s.count("cmd_touch")
+			s.hit("touch", it != nil)
+			if it != nil {
+				it.exptime = s.exptime(exp)
+			}
+		}
+		return s.textGet(rw, args[1:], cmd == "gats")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.textStore(rw, cmd, args)
+	case "delete":
+		if len(args) < 1 || len(args) > 3 {
+			return clientError(rw, "bad command line format")
+		}
+		noreply := args[len(args)-1] == "noreply"
+		it := s.lookup(args[0])
+		s.hit("delete", it != nil)
+		if it == nil {
+			return reply(rw, noreply, "NOT_FOUND")
+		}
+		delete(s.items, args[0])
+		return reply(rw, noreply, "DELETED")
+	case "incr", "decr":
+		if len(args) < 2 {
+			return clientError(rw, "bad command line format")
+		}
+		noreply := len(args) > 2 && args[2] == "noreply"
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return clientError(rw, "invalid numeric delta argument")
+		}
+		v, res, ok := s.incrDecr(args[0], cmd == "incr", delta)
+		if !ok {
+			return clientError(rw, "cannot increment or decrement non-numeric value")
+		}
+		if res == notFound {
+			return reply(rw, noreply, "NOT_FOUND")
+		}
+		return reply(rw, noreply, strconv.FormatUint(v, 10))
+	case "touch":
+		if len(args) < 2 {
+			return clientError(rw, "bad command line format")
+		}
+		noreply := len(args) > 2 && args[2] == "noreply"
+		exp, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return clientError(rw, "invalid exptime argument")
+		}
+		it := s.lookup(args[0])
+		s.count("cmd_touch")
+		s.hit("touch", it != nil)
+		if it == nil {
+			return reply(rw, noreply, "NOT_FOUND")
+		}
+		it.exptime = s.exptime(exp)
+		return reply(rw, noreply, "TOUCHED")
+	case "flush_all":
+		noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+		var delay int64
+		if len(args) > 0 && args[0] != "noreply" {
+			var err error
+			if delay, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+				return clientError(rw, "bad command line format")
+			}
+		}
+		s.flush(delay)
+		return reply(rw, noreply, "OK")
+	case "stats":
+		return s.textStats(rw, args)
+	case "version":
+		return reply(rw, false, "VERSION "+s.version)
+	case "verbosity":
+		if len(args) < 1 {
+			return reply(rw, false, "ERROR")
+		}
+		level, err := strconv.Atoi(args[0])
+		if err != nil {
+			return clientError(rw, "bad command line format")
+		}
+		s.verbosity = level
+		return reply(rw, len(args) > 1 && args[1] == "noreply", "OK")
+	case "cache_memlimit":
+		if len(args) < 1 {
+			return reply(rw, false, "ERROR")
+		}
+		mb, err := strconv.Atoi(args[0])
+		if err != nil || mb < 0 {
+			return clientError(rw, "bad command line format")
+		}
+		if mb < 8 {
+			return reply(rw, false, "MEMLIMIT_TOO_SMALL cannot set maxbytes to less than 8m")
+		}
+		s.maxBytes = mb << 20
+		return reply(rw, len(args) > 1 && args[1] == "noreply", "OK")
+	case "shutdown":
+		if !s.shutdown {
+			return reply(rw, false, "ERROR: shutdown not enabled")
+		}
+		go s.Close()
+		return false
+	case "quit":
+		return false
+	case "mn":
+		return reply(rw, false, "MN")
+	case "mg":
+		return s.metaGet(rw, args)
+	case "ms":
+		return s.metaSet(rw, args)
+	case "md":
+		return s.metaDelete(rw, args)
+	case "ma":
+		return s.metaArithmetic(rw, args)
+	}
+	return reply(rw, false, "ERROR")
+}
+
+func reply(w io.Writer, noreply bool, line string) bool {
+	if !noreply {
+		io.WriteString(w, line+"\r\n")
+	}
+	return true
+}
+
+func clientError(w io.Writer, msg string) bool {
+	io.WriteString(w, "CLIENT_ERROR "+msg+"\r\n")
+	return true
+}
+
+func (s *Server) textGet(w io.Writer, keys []string, withCAS bool) bool {
+	if len(keys) == 0 {
+		return reply(w, false, "ERROR")
+	}
+	for _, k := range keys {
+		if len(k) > maxKeyLen {
+			return clientError(w, "bad command line format")
+		}
+		it := s.lookup(k)
+		s.count("cmd_get")
+		s.hit("get", it != nil)
+		if it == nil {
+			continue
+		}
+		it.fetched = true
+		it.atime = s.unix()
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", k, it.flags, len(it.value), it.cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", k, it.flags, len(it.value))
+		}
+		w.Write(it.value)
+		io.WriteString(w, "\r\n")
+	}
+	return reply(w, false, "END")
+}
+
+func (s *Server) textStore(rw *bufio.ReadWriter, verb string, args []string) bool {
+	n := 4
+	if verb == "cas" {
+		n = 5
+	}
+	if len(args) < n || len(args[0]) > maxKeyLen {
+		return clientError(rw, "bad command line format")
+	}
+	noreply := len(args) > n && args[n] == "noreply"
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exp, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	var cas uint64
+	var err4 error
+	if verb == "cas" {
+		cas, err4 = strconv.ParseUint(args[4], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		return clientError(rw, "bad command line format")
+	}
+	value, ok := readData(rw.Reader, size)
+	if !ok {
+		return clientError(rw, "bad data chunk")
+	}
+	switch s.set(verb, args[0], uint32(flags), exp, cas, value) {
+	case notStored:
+		return reply(rw, noreply, "NOT_STORED")
+	case exists:
+		return reply(rw, noreply, "EXISTS")
+	case notFound:
+		return reply(rw, noreply, "NOT_FOUND")
+	}
+	return reply(rw, noreply, "STORED")
+}
+
+// readData reads a data block of size bytes followed by \r\n.
+func readData(r *bufio.Reader, size int) ([]byte, bool) {
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, false
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return nil, false
+	}
+	return buf[:size], true
+}
+
+type metaFlags []string
+
+func (fs metaFlags) has(c byte) bool {
+	_, ok := fs.token(c)
+	return ok
+}
+
+func (fs metaFlags) token(c byte) (string, bool) {
+	for _, f := range fs {
+		if f[0] == c {
+			return f[1:], true
+		}
+	}
+	return "", false
+}
+
+func (fs metaFlags) number(c byte) (int64, bool) {
+	t, ok := fs.token(c)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	return n, err == nil
+}
+
+// metaKey decodes the key of a meta command, honoring the b flag.
+func metaKey(key string, fs metaFlags) (string, bool) {
+	if !fs.has('b') {
+		return key, len(key) <= maxKeyLen
+	}
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) > maxKeyLen {
+		return "", false
+	}
+	return string(k), true
+}
+
+// echo returns the flags that are copied back into every meta response.
+func echo(raw string, fs metaFlags) []string {
+	var ret []string
+	for _, f := range fs {
+		switch f[0] {
+		case 'O':
+			ret = append(ret, f)
+		case 'k':
+			ret = append(ret, "k"+raw)
+		case 'b':
+			if fs.has('k') {
+				ret = append(ret, "b")
+			}
+		}
+	}
+	return ret
+}
+
+func metaLine(w io.Writer, code string, ret []string) bool {
+	if len(ret) == 0 {
+		return reply(w, false, code)
+	}
+	return reply(w, false, code+" "+strings.Join(ret, " "))
+}
+
+func (s *Server) ttl(it *item) int64 {
+	if it.exptime == 0 {
+		return -1
+	}
+	return it.exptime - s.unix()
+}
+
+func (s *Server) metaGet(w io.Writer, args []string) bool {
+	if len(args) < 1 {
+		return clientError(w, "bad command line format")
+	}
+	fs := metaFlags(args[1:])
+	key, ok := metaKey(args[0], fs)
+	if !ok {
+		return clientError(w, "bad command line format")
+	}
+
+	it, created := s.lookup(key), false
+	s.count("cmd_get")
+	s.hit("get", it != nil)
+	if it == nil {
+		ttl, ok := fs.number('N')
+		if !ok {
+			if fs.has('q') {
+				return true
+			}
+			return metaLine(w, "EN", nil)
+		}
+		it, created = &item{value: []byte{}, exptime: s.exptime(ttl)}, true
+		s.store(key, it)
+	}
+
+	win := created
+	if !created && !it.won {
+		if it.stale {
+			win = true
+		} else if r, ok := fs.number('R'); ok && it.exptime != 0 && s.ttl(it) < r {
+			win = true
+		}
+	}
+	if win {
+		it.won = true
+	}
+
+	ret := echo(args[0], fs)
+	for _, f := range fs {
+		switch f[0] {
+		case 'c':
+			ret = append(ret, "c"+strconv.FormatUint(it.cas, 10))
+		case 'f':
+			ret = append(ret, "f"+strconv.FormatUint(uint64(it.flags), 10))
+		case 'h':
+			if it.fetched {
+				ret = append(ret, "h1")
+			} else {
+				ret = append(ret, "h0")
+			}
+		case 'l':
+			ret = append(ret, "l"+strconv.FormatInt(s.unix()-it.atime, 10))
+		case 's':
+			ret = append(ret, "s"+strconv.Itoa(len(it.value)))
+		case 't':
+			ret = append(ret, "t"+strconv.FormatInt(s.ttl(it), 10))
+		case 'T':
+			if ttl, err := strconv.ParseInt(f[1:], 10, 64); err == nil {
+				it.exptime = s.exptime(ttl)
+			}
+		}
+	}
+	if win {
+		ret = append(ret, "W")
+	}
+	if it.stale {
+		ret = append(ret, "X")
+	}
+	if it.won && !win {
+		ret = append(ret, "Z")
+	}
+	if !created {
+		it.fetched = true
+	}
+	if !fs.has('u') {
+		it.atime = s.unix()
+	}
+
+	if !fs.has('v') {
+		return metaLine(w, "HD", ret)
+	}
+	metaLine(w, "VA "+strconv.Itoa(len(it.value)), ret)
+	w.Write(it.value)
+	return reply(w, false, "")
+}
+
+func (s *Server) metaSet(rw *bufio.ReadWriter, args []string) bool {
+	if len(args) < 2 {
+		return clientError(rw, "bad command line format")
+	}
+	fs := metaFlags(args[2:])
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size < 0 {
+		return clientError(rw, "bad data chunk")
+	}
+	value, ok := readData(rw.Reader, size)
+	if !ok {
+		return clientError(rw, "bad data chunk")
+	}
+	key, ok := metaKey(args[0], fs)
+	if !ok {
+		return clientError(rw, "bad command line format")
+	}
+
+	ret := echo(args[0], fs)
+	old := s.lookup(key)
+	s.count("cmd_set")
+	mode, _ := fs.token('M')
+	switch mode {
+	case "E", "e":
+		if old != nil {
+			return metaLine(rw, "NS", ret)
+		}
+	case "A", "a", "P", "p", "R", "r":
+		if old == nil {
+			return metaLine(rw, "NS", ret)
+		}
+	}
+
+	stale := false
+	if t, ok := fs.token('C'); ok {
+		cas, _ := strconv.ParseUint(t, 10, 64)
+		if old == nil {
+			return metaLine(rw, "NF", ret)
+		}
+		if cas != old.cas {
+			if !fs.has('I') || cas > old.cas {
+				return metaLine(rw, "EX", ret)
+			}
+			stale = true
+		}
+	}
+
+	it := &item{value: value}
+	if f, ok := fs.number('F'); ok {
+		it.flags = uint32(f)
+	}
+	if ttl, ok := fs.number('T'); ok {
+		it.exptime = s.exptime(ttl)
+	}
+	switch mode {
+	case "A", "a":
+		it.value = append(append([]byte{}, old.value...), value...)
+		it.flags, it.exptime = old.flags, old.exptime
+	case "P", "p":
+		it.value = append(append([]byte{}, value...), old.value...)
+		it.flags, it.exptime = old.flags, old.exptime
+	}
+	it.stale = stale
+	s.store(key, it)
+
+	if fs.has('c') {
+		ret = append(ret, "c"+strconv.FormatUint(it.cas, 10))
+	}
+	if fs.has('q') {
+		return true
+	}
+	return metaLine(rw, "HD", ret)
+}
+
+func (s *Server) metaDelete(w io.Writer, args []string) bool {
+	if len(args) < 1 {
+		return clientError(w, "bad command line format")
+	}
+	fs := metaFlags(args[1:])
+	key, ok := metaKey(args[0], fs)
+	if !ok {
+		return clientError(w, "bad command line format")
+	}
+
+	ret := echo(args[0], fs)
+	it := s.lookup(key)
+	s.hit("delete", it != nil)
+	if it == nil {
+		if fs.has('q') {
+			return true
+		}
+		return metaLine(w, "NF", ret)
+	}
+	if cas, ok := fs.token('C'); ok && cas != strconv.FormatUint(it.cas, 10) {
+		return metaLine(w, "EX", ret)
+	}
+	if fs.has('I') {
+		it.stale, it.won = true, false
+		it.cas = s.nextCAS()
+		if ttl, ok := fs.number('T'); ok {
+			it.exptime = s.exptime(ttl)
+		}
+	} else {
+		delete(s.items, key)
+	}
+	if fs.has('q') {
+		return true
+	}
+	return metaLine(w, "HD", ret)
+}
+
+func (s *Server) metaArithmetic(w io.Writer, args []string) bool {
+	if len(args) < 1 {
+		return clientError(w, "bad command line format")
+	}
+	fs := metaFlags(args[1:])
+	key, ok := metaKey(args[0], fs)
+	if !ok {
+		return clientError(w, "bad command line format")
+	}
+
+	ret := echo(args[0], fs)
+	it := s.lookup(key)
+	if it == nil {
+		ttl, ok := fs.number('N')
+		if !ok {
+			if fs.has('q') {
+				return true
+			}
+			return metaLine(w, "NF", ret)
+		}
+		init, _ := fs.token('J')
+		if init == "" {
+			init = "0"
+		}
+		it = &item{value: []byte(init), exptime: s.exptime(ttl)}
+		s.store(key, it)
+	} else {
+		if cas, ok := fs.token('C'); ok && cas != "0" && cas != strconv.FormatUint(it.cas, 10) {
+			return metaLine(w, "EX", ret)
+		}
+		delta := uint64(1)
+		if d, ok := fs.token('D'); ok {
+			delta, _ = strconv.ParseUint(d, 10, 64)
+		}
+		mode, _ := fs.token('M')
+		incr := mode != "D" && mode != "d" && mode != "-"
+		if _, _, ok := s.incrDecr(key, incr, delta); !ok {
+			return clientError(w, "cannot increment or decrement non-numeric value")
+		}
+		if ttl, ok := fs.number('T'); ok {
+			it.exptime = s.exptime(ttl)
+		}
+	}
+
+	for _, f := range fs {
+		switch f[0] {
+		case 'c':
+			ret = append(ret, "c"+strconv.FormatUint(it.cas, 10))
+		case 't':
+			ret = append(ret, "t"+strconv.FormatInt(s.ttl(it), 10))
+		}
+	}
+	if fs.has('q') {
+		return true
+	}
+	if !fs.has('v') {
+		return metaLine(w, "HD", ret)
+	}
+	metaLine(w, "VA "+strconv.Itoa(len(it.value)), ret)
+	w.Write(it.value)
+	return reply(w, false, "")
+}
@@ -7,7 +7,7 @@ import (
 )
 
 type MetaResult struct {
-	CasToken   casToken
+	CasToken   CasToken
 	Flags      uint32
 	Key        string
 	LastAccess uint64
@@ -18,16 +18,28 @@ type MetaResult struct {
 	Hit        bool
 	Won        bool
 	Stale      bool
+	// AlreadyWon is set if another client has won the recache of the item
+	// and not set it yet.
+	AlreadyWon bool
 
 	isNoOp bool
+	// pooled is set if Value is a buffer of the value pool.
+	pooled bool
 }
 
 // The meta get command is the generic command for retrieving key data from
 // memcached. Based on the flags supplied, it can replace all of the commands:
 // "get", "gets", "gat", "gats", "touch", as well as adding new options.
+//
+// If the server has no meta commands, ErrNotSupported is returned unless the
+// client falls back to the classic commands (see WithMetaFallback).
 func (c *Client) MetaGet(ctx context.Context, opt MetaGetOptions) (i MetaResult, err error) {
-	err = c.do(ctx, func(c *Conn) error {
-		i, err = c.metaCmd("mg", stringfyKey(opt.Key, opt.BinaryKey), opt.marshal(), nil)
+	key := stringfyKey(opt.Key, opt.BinaryKey)
+	err = c.doMeta(ctx, key, len(opt.BinaryKey) > 0, func(c *Conn) error {
+		i, err = c.metaCmd("mg", key, opt.marshal(), nil)
+		return err
+	}, func(c *Conn) error {
+		i, err = c.classicGet(key, opt)
 		return err
 	})
 	return
@@ -36,12 +48,19 @@ func (c *Client) MetaGet(ctx context.Context, opt MetaGetOptions) (i MetaResult,
 // The meta set command a generic command for storing data to memcached. Based
 // on the flags supplied, it can replace all storage commands (see token M) as
 // well as adds new options.
+//
+// If the server has no meta commands, ErrNotSupported is returned unless the
+// client falls back to the classic commands (see WithMetaFallback).
 func (c *Client) MetaSet(ctx context.Context, opt MetaSetOptions) (i MetaResult, err error) {
 	if opt.Value == nil {
 		opt.Value = []byte{}
 	}
-	err = c.do(ctx, func(c *Conn) error {
-		i, err = c.metaCmd("ms", stringfyKey(opt.Key, opt.BinaryKey), opt.marshal(), opt.Value)
+	key := stringfyKey(opt.Key, opt.BinaryKey)
+	err = c.doMeta(ctx, key, len(opt.BinaryKey) > 0, func(c *Conn) error {
+		i, err = c.metaCmd("ms", key, opt.marshal(), opt.Value)
+		return err
+	}, func(c *Conn) error {
+		i, err = c.classicSet(key, opt)
 		return err
 	})
 	return
@@ -50,10 +69,11 @@ func (c *Client) MetaSet(ctx context.Context, opt MetaSetOptions) (i MetaResult,
 // The meta delete command allows for explicit deletion of items, as well as
 // marking items as "stale" to allow serving items as stale during revalidation.
 func (c *Client) MetaDelete(ctx context.Context, opt MetaDeletOptions) (i MetaResult, err error) {
-	err = c.do(ctx, func(c *Conn) error {
-		i, err = c.metaCmd("md", stringfyKey(opt.Key, opt.BinaryKey), opt.marshal(), nil)
+	key := stringfyKey(opt.Key, opt.BinaryKey)
+	err = c.doMeta(ctx, key, len(opt.BinaryKey) > 0, func(c *Conn) error {
+		i, err = c.metaCmd("md", key, opt.marshal(), nil)
 		return err
-	})
+	}, nil)
 	return
 }
 
@@ -62,8 +82,9 @@ func (c *Client) MetaDelete(ctx context.Context, opt MetaDeletOptions) (i MetaRe
 // 64bit integers. Decrementing will reach 0 rather than underflow. Incrementing
 // can overflow.
 func (c *Client) MetaArithmetic(ctx context.Context, opt MetaArithmeticOptions) (v uint64, i MetaResult, err error) {
-	err = c.do(ctx, func(c *Conn) error {
-		if i, err = c.metaCmd("ma", stringfyKey(opt.Key, opt.BinaryKey), opt.marshal(), nil); err != nil {
+	key := stringfyKey(opt.Key, opt.BinaryKey)
+	err = c.doMeta(ctx, key, len(opt.BinaryKey) > 0, func(c *Conn) error {
+		if i, err = c.metaCmd("ma", key, opt.marshal(), nil); err != nil {
 			return err
 		}
 		if opt.GetValue {
@@ -71,7 +92,7 @@ func (c *Client) MetaArithmetic(ctx context.Context, opt MetaArithmeticOptions)
 			return err
 		}
 		return nil
-	})
+	}, nil)
 	return
 }
 
@@ -0,0 +1,79 @@
+package memcache
+
+// classicGet runs a meta get with the classic gets, gats or touch command,
+// for servers without the meta commands. Options which cannot be expressed
+// with them result in ErrNotSupported.
+func (c *Conn) classicGet(key string, opt MetaGetOptions) (mr MetaResult, err error) {
+	if len(opt.BinaryKey) > 0 || opt.GetHit || opt.GetLastAccess || opt.GetTTL ||
+		opt.SetVivifyWithTTL != 0 || opt.RecacheWithTTL != 0 || opt.NoBump {
+		return mr, ErrNotSupported
+	}
+	if !legalKey(key) {
+		return mr, ErrMalformedKey
+	}
+
+	if opt.SetTTL != 0 && !opt.GetValue && !opt.GetFlags && !opt.GetSize && !opt.GetCasToken {
+		return mr, c.Touch(key, int32(opt.SetTTL))
+	}
+
+	var it *Item
+	if opt.SetTTL != 0 {
+		it, err = c.GetAndTouch(key, int32(opt.SetTTL))
+	} else {
+		var items map[string]*Item
+		items, err = c.GetMulti([]string{key})
+		if it = items[key]; err == nil && it == nil {
+			err = ErrCacheMiss
+		}
+	}
+	if err != nil {
+		return mr, err
+	}
+
+	if opt.GetValue {
+		mr.Value, mr.pooled = it.Value, it.pooled
+	}
+	if opt.GetFlags {
+		mr.Flags = it.Flags
+	}
+	if opt.GetSize {
+		mr.Size = len(it.Value)
+	}
+	mr.CasToken = NewCasToken(it.CAS)
+	return mr, nil
+}
+
+// classicSet runs a meta set with the classic storage commands, for
+// servers without the meta commands. Options which cannot be expressed
+// with them result in ErrNotSupported.
+func (c *Conn) classicSet(key string, opt MetaSetOptions) (mr MetaResult, err error) {
+	if len(opt.BinaryKey) > 0 || opt.GetCasToken || opt.SetInvalidate {
+		return mr, ErrNotSupported
+	}
+
+	var verb string
+	switch opt.Mode {
+	case MetaSetModeEmpty, MetaSetModeSet:
+		verb = "set"
+	case MetaSetModeAdd:
+		verb = "add"
+	case MetaSetModeAppend:
+		verb = "append"
+	case MetaSetModePrepend:
+		verb = "prepend"
+	case MetaSetModeReplace:
+		verb = "replace"
+	default:
+		return mr, ErrNotSupported
+	}
+
+	item := &Item{Key: key, Value: opt.Value, Flags: opt.SetFlag, Expiration: int32(opt.SetTTL)}
+	if opt.CasToken.setted {
+		if verb != "set" {
+			return mr, ErrNotSupported
+		}
+		verb = "cas"
+		item.CAS = opt.CasToken.value
+	}
+	return mr, c.populateOne(verb, item)
+}
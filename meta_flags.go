@@ -3,53 +3,54 @@ package memcache
 import (
 	"fmt"
 	"strconv"
-	"strings"
 )
 
 type metaFlag = string
 
-func buildMetaFlags(fs []metaFlag) string {
-	return strings.Join(fs, " ")
-}
-
-func obtainMetaFlagsResults(ss []string) (mr MetaResult, err error) {
+// obtainMetaFlagsResults parses the space separated return flags of a meta
+// response.
+func obtainMetaFlagsResults(flags []byte) (mr MetaResult, err error) {
 	// Always set the cas token as setted
 	// enforce the operation use this token always use the CasToken.value
 	// even if the token is not returned.
 	// To avoid unexpected non-cas opertion caused by the lack of "c" flag.
 	mr.CasToken.setted = true
-	for _, f := range ss {
+	for len(flags) > 0 {
+		var f []byte
+		if f, flags = nextToken(flags); len(f) == 0 {
+			continue
+		}
 		k, v := f[0], f[1:]
 		switch k {
 		case 'W':
 			mr.Won = true
 		case 'Z':
 			mr.Won = false
+			mr.AlreadyWon = true
 		case 'X':
 			mr.Stale = true
 		case 'k':
-			mr.Key = v
+			mr.Key = string(v)
 		case 'O':
-			mr.Opaque = v
+			mr.Opaque = string(v)
 		case 'c':
-			mr.CasToken.value, err = strconv.ParseInt(v, 10, 64)
+			mr.CasToken.value, err = parseUint(v)
 		case 'f':
-			v, err := strconv.ParseUint(v, 10, 32)
-			if err != nil {
-				return mr, err
-			}
-			mr.Flags = uint32(v)
+			mr.Flags, err = parseUint32(v)
 		case 'h':
-			mr.Hit = (v[0] == '1')
+			mr.Hit = len(v) > 0 && v[0] == '1'
 		case 'l':
-			mr.LastAccess, err = strconv.ParseUint(v, 10, 64)
+			mr.LastAccess, err = parseUint(v)
 		case 's':
-			mr.Size, err = strconv.Atoi(v)
+			mr.Size, err = parseSize(v)
 		case 't':
-			mr.TTL, err = strconv.ParseInt(v, 10, 64)
+			mr.TTL, err = parseInt(v)
 		default:
 			err = fmt.Errorf("Invalid flag: %c", k)
 		}
+		if err != nil {
+			return
+		}
 	}
 	return
 }
@@ -74,6 +75,11 @@ func withHit() metaFlag {
 	return "h"
 }
 
+// withKey - k: return key as a token
+func withKey() metaFlag {
+	return "k"
+}
+
 // withLastAccess - l: return time since item was last accessed in seconds
 func withLastAccess() metaFlag {
 	return "l"
@@ -125,8 +131,8 @@ func withSetTTL(token uint64) metaFlag {
 }
 
 // withCompareCAS - C(token): compare CAS value when storing item
-func withCompareCAS(token int64) metaFlag {
-	return "C" + strconv.FormatInt(token, 10)
+func withCompareCAS(token uint64) metaFlag {
+	return "C" + strconv.FormatUint(token, 10)
 }
 
 // withSetFlag - F(token): set client flags to token (32 bit unsigned numeric)
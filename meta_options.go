@@ -1,10 +1,29 @@
 package memcache
 
-type casToken struct {
-	value  int64
+// CasToken is the compare and swap token of an item, returned by the meta
+// commands with GetCasToken and passed back in their options. The zero
+// value is no token.
+type CasToken struct {
+	value  uint64
 	setted bool
 }
 
+// NewCasToken returns the token of the compare and swap value v, e.g. the
+// CAS of an Item or a token value stored elsewhere.
+func NewCasToken(v uint64) CasToken {
+	return CasToken{value: v, setted: true}
+}
+
+// Value returns the compare and swap value of t.
+func (t CasToken) Value() uint64 {
+	return t.value
+}
+
+// IsSet reports whether t holds a token.
+func (t CasToken) IsSet() bool {
+	return t.setted
+}
+
 type MetaGetOptions struct {
 	Key       string // the key of item
 	BinaryKey []byte // interpret key as base64 encoded binary value
@@ -79,7 +98,7 @@ type MetaSetOptions struct {
 	Key       string   // the key of item
 	BinaryKey []byte   // interpret key as base64 encoded binary value (see metaget)
 	Value     []byte   // the value of item
-	CasToken  casToken // compare and swap token
+	CasToken  CasToken // compare and swap token
 
 	GetCasToken bool // return CAS value if successfully stored.
 
@@ -118,7 +137,7 @@ func (o MetaSetOptions) marshal() (fs []metaFlag) {
 type MetaDeletOptions struct {
 	Key       string   // the key of item
 	BinaryKey []byte   // interpret key as base64 encoded binary value (see metaget)
-	CasToken  casToken // compare and swap token
+	CasToken  CasToken // compare and swap token
 
 	SetTTL        uint64 // updates TTL, only when paired with the SetInvalidate option
 	SetInvalidate bool   // mark as stale, bumps CAS.
@@ -151,7 +170,7 @@ const (
 type MetaArithmeticOptions struct {
 	Key       string   // the key of item
 	BinaryKey []byte   // interpret key as base64 encoded binary value (see metaget)
-	CasToken  casToken // compare and swap token
+	CasToken  CasToken // compare and swap token
 
 	GetCasToken bool // return current CAS value if successful.
 	GetTTL      bool // return current TTL
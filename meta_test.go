@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"math"
 	"os"
 	"strconv"
@@ -11,6 +12,50 @@ import (
 	"time"
 )
 
+func TestCasTokenExport(t *testing.T) {
+	c, _ := New(os.Getenv("MC_ADDRESS"), 0, 10)
+	defer c.Close()
+	ctx := context.Background()
+
+	if tok := (CasToken{}); tok.IsSet() || tok.Value() != 0 {
+		t.Errorf("zero CasToken = %+v", tok)
+	}
+
+	// The CAS of an item survives serialization.
+	c.Set(ctx, &Item{Key: "export", Value: []byte("a")})
+	it, err := c.Get(ctx, "export")
+	if err != nil || it.CAS == 0 {
+		t.Fatalf("Get = %+v, %v", it, err)
+	}
+	b, _ := json.Marshal(it)
+	var stored Item
+	json.Unmarshal(b, &stored)
+	stored.Value = []byte("b")
+	if err := c.CompareAndSwap(ctx, &stored); err != nil {
+		t.Errorf("CompareAndSwap of deserialized item: %v", err)
+	}
+	if err := c.CompareAndSwap(ctx, &stored); err != ErrCASConflict {
+		t.Errorf("second CompareAndSwap: %v", err)
+	}
+
+	// A token built from a stored number works with the meta commands.
+	mr, err := c.MetaGet(ctx, MetaGetOptions{Key: "export", GetCasToken: true})
+	if err != nil || !mr.CasToken.IsSet() || mr.CasToken.Value() == 0 {
+		t.Fatalf("MetaGet = %+v, %v", mr, err)
+	}
+	stale := NewCasToken(mr.CasToken.Value() - 1)
+	if _, err := c.MetaSet(ctx, MetaSetOptions{Key: "export", Value: []byte("c"), CasToken: stale}); err != ErrCASConflict {
+		t.Errorf("MetaSet with stale token: %v", err)
+	}
+	tok := NewCasToken(mr.CasToken.Value())
+	if _, err := c.MetaSet(ctx, MetaSetOptions{Key: "export", Value: []byte("c"), CasToken: tok}); err != nil {
+		t.Errorf("MetaSet with token: %v", err)
+	}
+	if it, _ := c.Get(ctx, "export"); string(it.Value) != "c" {
+		t.Errorf("Get = %q, want c", it.Value)
+	}
+}
+
 func TestMetaSetGet(t *testing.T) {
 	c, _ := New(os.Getenv("MC_ADDRESS"), 2, 100)
 
@@ -127,7 +172,7 @@ func TestMetaSetCAS(t *testing.T) {
 	_, err = c.MetaSet(ctx, MetaSetOptions{
 		Key:      k,
 		Value:    v,
-		CasToken: casToken{0, true},
+		CasToken: CasToken{0, true},
 	})
 	if err != ErrCASConflict {
 		t.Error("CAS Invalid")
@@ -178,7 +223,7 @@ func TestAdvancedMeta(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if r2.Won {
+	if r2.Won || !r2.AlreadyWon {
 		t.Error("Sent Won fail")
 	}
 
@@ -0,0 +1,417 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kiss/net/pool"
+)
+
+// With Options.Multiplex, the commands of all goroutines share a few
+// connections to every server instead of taking one from the pool each.
+//
+// A command is written by the usual Conn or BinaryConn code into a buffer
+// of its own. Flushing it hands the buffer to the writer of the shared
+// connection, which writes all commands queued meanwhile with a single
+// flush. The responses come back in the order the commands were written,
+// so every command waits for its turn, reads its response from the shared
+// reader itself and passes the turn on to the next command.
+//
+// A command whose ctx is done before its turn gives up at once, but stays
+// in line: the turn loop reads and discards its response when it comes. The
+// connection is only closed if that fails, or if a command fails with its
+// turn.
+
+// maxMuxBatch is the most commands written with one flush.
+const maxMuxBatch = 128
+
+// defaultMuxDiscardTimeout is how long the response of a command which gave
+// up is waited for if there is no read timeout.
+const defaultMuxDiscardTimeout = time.Second
+
+// muxConn is a connection shared by the commands of concurrent goroutines.
+type muxConn struct {
+	nc   net.Conn
+	rw   *bufio.ReadWriter
+	opts *Options
+
+	// queue holds the commands to be written, written the commands waiting
+	// for their turn to read their response.
+	queue   chan *muxRequest
+	written chan *muxRequest
+
+	once   sync.Once
+	closed chan struct{}
+	err    error // set before closed is closed
+}
+
+func newMuxConn(nc net.Conn, rw *bufio.ReadWriter, opts *Options) *muxConn {
+	m := &muxConn{
+		nc:      nc,
+		rw:      rw,
+		opts:    opts,
+		queue:   make(chan *muxRequest, maxMuxBatch),
+		written: make(chan *muxRequest, maxMuxBatch),
+		closed:  make(chan struct{}),
+	}
+	go m.writeLoop()
+	go m.turnLoop()
+	return m
+}
+
+// fail closes m. The commands in flight fail with err.
+func (m *muxConn) fail(err error) {
+	m.once.Do(func() {
+		m.err = fmt.Errorf("memcache: multiplexed connection failed: %v", err)
+		close(m.closed)
+		m.nc.Close()
+	})
+}
+
+func (m *muxConn) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeLoop writes the queued commands in batches.
+func (m *muxConn) writeLoop() {
+	batch := make([]*muxRequest, 0, maxMuxBatch)
+	for {
+		var r *muxRequest
+		select {
+		case r = <-m.queue:
+		case <-m.closed:
+			return
+		}
+
+		if m.opts.WriteTimeout > 0 {
+			m.nc.SetWriteDeadline(time.Now().Add(m.opts.WriteTimeout))
+		}
+		batch = batch[:0]
+		for r != nil {
+			if _, err := m.rw.Write(r.buf.Bytes()); err != nil {
+				m.fail(err)
+				return
+			}
+			batch = append(batch, r)
+
+			r = nil
+			if len(batch) < maxMuxBatch {
+				select {
+				case r = <-m.queue:
+				default:
+				}
+			}
+		}
+		if err := m.rw.Flush(); err != nil {
+			m.fail(err)
+			return
+		}
+
+		for _, r := range batch {
+			select {
+			case m.written <- r:
+			case <-m.closed:
+				return
+			}
+		}
+	}
+}
+
+// turnLoop gives the written commands their turn to read, one after the
+// other, once their response has begun to arrive. The responses of the
+// commands which gave up are discarded.
+func (m *muxConn) turnLoop() {
+	for {
+		var r *muxRequest
+		select {
+		case r = <-m.written:
+		case <-m.closed:
+			return
+		}
+
+		m.setWaitDeadline(r.ctx)
+		if _, err := m.rw.Peek(1); err != nil {
+			m.fail(err)
+			return
+		}
+		select {
+		case r.turn <- struct{}{}:
+		case <-r.abandoned:
+			if err := m.discard(r); err != nil {
+				m.fail(err)
+				return
+			}
+			continue
+		case <-m.closed:
+			return
+		}
+		select {
+		case <-r.done:
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+// discard reads and discards the response to the command r, which has
+// given up.
+func (m *muxConn) discard(r *muxRequest) error {
+	m.nc.SetReadDeadline(time.Now().Add(m.discardTimeout()))
+	if m.opts.Protocol == ProtocolBinary {
+		return discardBinary(m.rw.Reader, r.buf.Bytes())
+	}
+	return discardText(m.rw.Reader, r.buf.Bytes())
+}
+
+func (m *muxConn) discardTimeout() time.Duration {
+	if m.opts.ReadTimeout > 0 {
+		return m.opts.ReadTimeout
+	}
+	return defaultMuxDiscardTimeout
+}
+
+// setWaitDeadline bounds the wait for the response of a command with ctx.
+// A command may give up at its ctx deadline, the server is given the
+// discard timeout more to answer before the connection is closed.
+func (m *muxConn) setWaitDeadline(ctx context.Context) {
+	var d time.Time
+	if dl, ok := ctx.Deadline(); ok {
+		d = dl.Add(m.discardTimeout())
+	} else if m.opts.ReadTimeout > 0 {
+		d = time.Now().Add(m.opts.ReadTimeout)
+	}
+	m.nc.SetReadDeadline(d)
+}
+
+// setReadDeadline bounds the read of a response by the ctx deadline of its
+// command, or by the configured read timeout if ctx has none.
+func (m *muxConn) setReadDeadline(ctx context.Context) {
+	var d time.Time
+	if dl, ok := ctx.Deadline(); ok {
+		d = dl
+	} else if m.opts.ReadTimeout > 0 {
+		d = time.Now().Add(m.opts.ReadTimeout)
+	}
+	m.nc.SetReadDeadline(d)
+}
+
+// muxRequest is a command over a muxConn. It may be followed by more
+// commands, e.g. when the capabilities of the server are probed first,
+// which are sent once the response of the previous one has been read.
+type muxRequest struct {
+	m   *muxConn
+	ctx context.Context
+
+	buf    bytes.Buffer
+	rw     bufio.ReadWriter
+	text   Conn
+	binary BinaryConn
+
+	// sent is set once the command is queued, turned once it may read its
+	// response. abandoned is closed if the command gives up before its
+	// turn, a request is not reused then.
+	sent, turned bool
+	turn, done   chan struct{}
+	abandoned    chan struct{}
+	// gaveUp is set if the command gave up, with its response discarded
+	// or left to the turn loop.
+	gaveUp bool
+}
+
+// send queues the command and waits for its turn to read the response.
+// If ctx is done before, the command gives up and its response is left to
+// the turn loop.
+func (r *muxRequest) send() error {
+	m := r.m
+	if r.turned {
+		// The response of the previous command has been read.
+		select {
+		case r.done <- struct{}{}:
+		case <-m.closed:
+			return m.err
+		}
+		r.sent, r.turned = false, false
+	}
+	r.rw.Writer.Flush()
+
+	select {
+	case m.queue <- r:
+	case <-m.closed:
+		return m.err
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	r.sent = true
+
+	select {
+	case <-r.turn:
+	case <-m.closed:
+		return m.err
+	case <-r.ctx.Done():
+		r.gaveUp = true
+		close(r.abandoned)
+		return r.ctx.Err()
+	}
+	r.turned = true
+	if err := r.ctx.Err(); err != nil {
+		// ctx is done as the turn came, the response is discarded here.
+		r.gaveUp = true
+		if derr := m.discard(r); derr != nil {
+			m.fail(derr)
+		}
+		return err
+	}
+	// The command has been written, the next one goes into the buffer.
+	r.buf.Reset()
+	m.setReadDeadline(r.ctx)
+	return nil
+}
+
+// finish passes the turn of r on. The connection is closed if err leaves
+// it in an unknown state. It returns whether r may be reused.
+func (r *muxRequest) finish(err error) bool {
+	if !r.sent {
+		return true
+	}
+	m := r.m
+	if !r.turned {
+		// r gave up or m is closed.
+		return false
+	}
+	if !r.gaveUp && !IsResumableErr(err) {
+		m.fail(err)
+	}
+	select {
+	case r.done <- struct{}{}:
+		return true
+	case <-m.closed:
+		return false
+	}
+}
+
+// muxPool holds the multiplexed connections to a server. They are dialed
+// when first used and again after they failed.
+type muxPool struct {
+	addr  string
+	opts  *Options
+	next  uint32
+	slots []muxSlot
+	reqs  sync.Pool
+
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+type muxSlot struct {
+	mu sync.Mutex
+	m  *muxConn
+}
+
+func newMuxPool(addr string, opts *Options) *muxPool {
+	return &muxPool{addr: addr, opts: opts, slots: make([]muxSlot, opts.Multiplex)}
+}
+
+// get returns the next connection in turn, dialing it if needed.
+func (p *muxPool) get(ctx context.Context) (*muxConn, error) {
+	s := &p.slots[atomic.AddUint32(&p.next, 1)%uint32(len(p.slots))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m != nil && !s.m.isClosed() {
+		return s.m, nil
+	}
+
+	nc, cn, err := dialConn(ctx, p.addr, *p.opts)
+	if err != nil {
+		return nil, err
+	}
+	var rw *bufio.ReadWriter
+	switch cn := cn.(type) {
+	case *Conn:
+		rw = cn.rw
+	case *BinaryConn:
+		rw = cn.rw
+	}
+
+	// Close may have run while dialing.
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		nc.Close()
+		return nil, pool.ErrClosed
+	}
+	s.m = newMuxConn(nc, rw, p.opts)
+	return s.m, nil
+}
+
+// do runs fn with a command over one of the connections of p.
+func (p *muxPool) do(ctx context.Context, fn func(c conn) error) error {
+	p.closeMu.RLock()
+	closed := p.closed
+	p.closeMu.RUnlock()
+	if closed {
+		return pool.ErrClosed
+	}
+
+	m, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, ok := p.reqs.Get().(*muxRequest)
+	if !ok {
+		r = &muxRequest{turn: make(chan struct{}), done: make(chan struct{}), abandoned: make(chan struct{})}
+		r.rw.Writer = bufio.NewWriterSize(&r.buf, p.opts.WriteBufferSize)
+	}
+	r.m, r.ctx = m, ctx
+	r.rw.Reader = m.rw.Reader
+
+	var cn conn
+	if p.opts.Protocol == ProtocolBinary {
+		r.binary = BinaryConn{rw: &r.rw, mux: r}
+		cn = &r.binary
+	} else {
+		r.text = Conn{rw: &r.rw, pooled: p.opts.ValuePool, mux: r}
+		cn = &r.text
+	}
+
+	err = fn(cn)
+	if r.finish(err) && r.buf.Cap() <= maxReusedMuxBuffer {
+		r.m, r.ctx, r.rw.Reader = nil, nil, nil
+		r.sent, r.turned, r.gaveUp = false, false, false
+		r.buf.Reset()
+		r.rw.Writer.Reset(&r.buf)
+		p.reqs.Put(r)
+	}
+	return err
+}
+
+// maxReusedMuxBuffer is the largest command buffer kept for reuse, larger
+// ones have been grown by large values.
+const maxReusedMuxBuffer = 64 << 10
+
+// Close closes the connections of p. The commands in flight fail.
+func (p *muxPool) Close() {
+	p.closeMu.Lock()
+	p.closed = true
+	p.closeMu.Unlock()
+
+	for i := range p.slots {
+		s := &p.slots[i]
+		s.mu.Lock()
+		if s.m != nil {
+			s.m.fail(pool.ErrClosed)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,180 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// The response of a command which gave up before its turn is read and
+// discarded by the turn loop of its multiplexed connection. Its length is
+// derived from the commands written, as the code which would have parsed
+// it has returned.
+
+var errUndiscardable = errors.New("memcache: response cannot be discarded")
+
+// discardText reads and discards the responses to the text commands cmds.
+func discardText(r *bufio.Reader, cmds []byte) error {
+	for len(cmds) > 0 {
+		i := bytes.Index(cmds, crlf)
+		if i < 0 {
+			return errUndiscardable
+		}
+		fields := bytes.Fields(cmds[:i])
+		cmds = cmds[i+2:]
+		if len(fields) == 0 {
+			return errUndiscardable
+		}
+		last := string(fields[len(fields)-1])
+
+		var err error
+		switch string(fields[0]) {
+		case "set", "add", "replace", "append", "prepend", "cas", "ms":
+			pos := 4
+			if string(fields[0]) == "ms" {
+				pos = 2
+			}
+			if len(fields) <= pos {
+				return errUndiscardable
+			}
+			size, perr := strconv.Atoi(string(fields[pos]))
+			if perr != nil || size < 0 || size+2 > len(cmds) {
+				return errUndiscardable
+			}
+			cmds = cmds[size+2:]
+			switch {
+			case last == "noreply":
+			case string(fields[0]) == "ms":
+				err = discardMeta(r, fields)
+			default:
+				_, err = r.ReadSlice('\n')
+			}
+		case "mg", "md", "ma", "mn":
+			err = discardMeta(r, fields)
+		case "get", "gets", "gat", "gats":
+			err = discardValues(r)
+		case "stats":
+			err = discardStats(r)
+		case "delete", "touch", "incr", "decr", "version", "verbosity", "flush_all", "cache_memlimit":
+			if last != "noreply" {
+				_, err = r.ReadSlice('\n')
+			}
+		default:
+			return errUndiscardable
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardMeta discards the response to the meta command of fields, with
+// its value if it has one. Quiet commands may not be answered at all.
+func discardMeta(r *bufio.Reader, fields [][]byte) error {
+	for i := 2; i < len(fields); i++ {
+		if bytes.Equal(fields[i], []byte("q")) {
+			return errUndiscardable
+		}
+	}
+	line, err := r.ReadSlice('\n')
+	if err != nil || !bytes.HasPrefix(line, []byte("VA ")) {
+		return err
+	}
+	fs := bytes.Fields(line)
+	if len(fs) < 2 {
+		return errUndiscardable
+	}
+	return discardData(r, fs[1])
+}
+
+// discardValues discards the VALUE lines and values up to the END of a get.
+func discardValues(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(line, []byte("VALUE ")) {
+			// END or an error.
+			return nil
+		}
+		fs := bytes.Fields(line)
+		if len(fs) < 4 {
+			return errUndiscardable
+		}
+		if err := discardData(r, fs[3]); err != nil {
+			return err
+		}
+	}
+}
+
+// discardStats discards the STAT lines up to the END of stats.
+func discardStats(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil || !bytes.HasPrefix(line, resultStatPrefix) {
+			// END or an error.
+			return err
+		}
+	}
+}
+
+// discardData discards a value of size bytes and its trailing CRLF.
+func discardData(r *bufio.Reader, size []byte) error {
+	n, err := strconv.Atoi(string(size))
+	if err != nil || n < 0 {
+		return errUndiscardable
+	}
+	_, err = r.Discard(n + 2)
+	return err
+}
+
+// discardBinary reads and discards the responses to the binary requests
+// cmds. The responses to quiet requests come in between if at all.
+func discardBinary(r *bufio.Reader, cmds []byte) error {
+	type answered struct {
+		opaque uint32
+		stat   bool
+	}
+	var want []answered
+	for len(cmds) > 0 {
+		if len(cmds) < binaryHeaderSize {
+			return errUndiscardable
+		}
+		op := cmds[1]
+		bodyLen := int(binary.BigEndian.Uint32(cmds[8:12]))
+		if binaryHeaderSize+bodyLen > len(cmds) {
+			return errUndiscardable
+		}
+		if op != opGetKQ && op != opGATKQ && op != opFlushQ {
+			want = append(want, answered{opaque: binary.BigEndian.Uint32(cmds[12:16]), stat: op == opStat})
+		}
+		cmds = cmds[binaryHeaderSize+bodyLen:]
+	}
+
+	var h [binaryHeaderSize]byte
+	for len(want) > 0 {
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return err
+		}
+		if h[0] != binaryResMagic {
+			return errUndiscardable
+		}
+		keyLen := binary.BigEndian.Uint16(h[2:4])
+		status := binary.BigEndian.Uint16(h[6:8])
+		if _, err := r.Discard(int(binary.BigEndian.Uint32(h[8:12]))); err != nil {
+			return err
+		}
+		// The stats are answered with a response per statistic, up to
+		// one without key.
+		w := want[0]
+		if binary.BigEndian.Uint32(h[12:16]) == w.opaque && (!w.stat || keyLen == 0 || status != statusOK) {
+			want = want[1:]
+		}
+	}
+	return nil
+}
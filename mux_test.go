@@ -0,0 +1,343 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
+	"github.com/go-kiss/net/pool"
+)
+
+func TestClientMultiplex(t *testing.T) {
+	for _, proto := range []Protocol{ProtocolText, ProtocolBinary} {
+		s := memcachetest.NewServer()
+		ctx := context.Background()
+		c, err := New(s.Addr(), 0, 10, WithProtocol(proto), WithMultiplex(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 100)
+		for g := 0; g < 100; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					key := fmt.Sprintf("mux%d_%d", g, i)
+					value := fmt.Sprintf("value %d %d", g, i)
+					if err := c.Set(ctx, &Item{Key: key, Value: []byte(value)}); err != nil {
+						errs <- err
+						return
+					}
+					it, err := c.Get(ctx, key)
+					if err != nil || string(it.Value) != value {
+						errs <- fmt.Errorf("Get(%s) = %+v, %v", key, it, err)
+						return
+					}
+					if _, err := c.Get(ctx, key+"_missing"); err != ErrCacheMiss {
+						errs <- fmt.Errorf("Get of a missing key = %v", err)
+						return
+					}
+					m, err := c.GetMulti(ctx, []string{key, key + "_missing"})
+					if err != nil || len(m) != 1 || string(m[key].Value) != value {
+						errs <- fmt.Errorf("GetMulti(%s) = %v, %v", key, m, err)
+						return
+					}
+					if proto == ProtocolText {
+						mr, err := c.MetaGet(ctx, MetaGetOptions{Key: key, GetValue: true})
+						if err != nil || string(mr.Value) != value {
+							errs <- fmt.Errorf("MetaGet(%s) = %+v, %v", key, mr, err)
+							return
+						}
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("protocol %d: %v", proto, err)
+		}
+
+		if n := s.Stat("total_connections"); n != 2 {
+			t.Errorf("protocol %d: %d connections, want 2", proto, n)
+		}
+		if st := c.PoolStats(); st.TotalConns != 0 {
+			t.Errorf("protocol %d: pool used: %+v", proto, st)
+		}
+
+		c.Close()
+		if _, err := c.Get(ctx, "mux0_0"); err != pool.ErrClosed {
+			t.Errorf("protocol %d: Get after Close = %v", proto, err)
+		}
+		s.Close()
+	}
+}
+
+func TestClientMultiplexMetaBatch(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	c, _ := New(s.Addr(), 0, 10, WithMultiplex(1))
+	defer c.Close()
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches run on pooled connections beside the multiplexed commands.
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for g := 0; g < 10; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				var b MetaBatch
+				key := fmt.Sprintf("batch%d_%d", g, i)
+				b.Set(MetaSetOptions{Key: key, Value: []byte(key)})
+				b.Get(MetaGetOptions{Key: key, GetValue: true})
+				b.Get(MetaGetOptions{Key: key + "_missing", GetValue: true})
+				rs, err := c.MetaBatch(ctx, &b)
+				if err != nil || rs[0].Err != nil || string(rs[1].Value) != key || rs[2].Err != ErrCacheMiss {
+					errs <- fmt.Errorf("MetaBatch(%s) = %+v, %v", key, rs, err)
+					return
+				}
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if it, err := c.Get(ctx, "foo"); err != nil || string(it.Value) != "bar" {
+					errs <- fmt.Errorf("Get = %+v, %v", it, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestClientMultiplexStream(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789abcdef"), 32<<10) // 512 KB
+	for _, proto := range []Protocol{ProtocolText, ProtocolBinary} {
+		s := memcachetest.NewServer()
+		ctx := context.Background()
+		c, _ := New(s.Addr(), 0, 10, WithProtocol(proto), WithMultiplex(1))
+		if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The values are streamed over pooled connections, a failing reader
+		// or writer leaves the shared one alone.
+		if err := c.SetFrom(ctx, "stream", bytes.NewReader(value), int64(len(value)), 0, 0); err != nil {
+			t.Fatalf("protocol %d: SetFrom: %v", proto, err)
+		}
+		if st := c.PoolStats(); st.TotalConns != 1 {
+			t.Errorf("protocol %d: SetFrom did not use the pool: %+v", proto, st)
+		}
+		err := c.SetFrom(ctx, "stream-short", io.LimitReader(bytes.NewReader(value), 100), 200, 0, 0)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("protocol %d: SetFrom of a short reader = %v", proto, err)
+		}
+		if it, err := c.Get(ctx, "stream"); err != nil || !bytes.Equal(it.Value, value) {
+			t.Errorf("protocol %d: Get after SetFrom = %v", proto, err)
+		}
+
+		// A failing writer of GetTo breaks its pooled connection only.
+		if _, err := c.GetTo(ctx, "stream", &failingWriter{n: 1000}); err == nil {
+			t.Errorf("protocol %d: GetTo of a failing writer succeeded", proto)
+		}
+		var buf bytes.Buffer
+		if _, err := c.GetTo(ctx, "stream", &buf); err != nil || !bytes.Equal(buf.Bytes(), value) {
+			t.Errorf("protocol %d: GetTo = %v", proto, err)
+		}
+		if st := c.PoolStats(); st.TotalConns != 1 {
+			t.Errorf("protocol %d: GetTo did not use the pool: %+v", proto, st)
+		}
+		if it, err := c.Get(ctx, "foo"); err != nil || string(it.Value) != "bar" {
+			t.Errorf("protocol %d: Get = %+v, %v", proto, it, err)
+		}
+		// The shared connection and the three pooled ones, of which the
+		// short reader and the failing writer broke two.
+		if n := s.Stat("total_connections"); n != 4 {
+			t.Errorf("protocol %d: %d connections, want 4", proto, n)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestClientMultiplexAdmin(t *testing.T) {
+	for _, proto := range []Protocol{ProtocolText, ProtocolBinary} {
+		s := memcachetest.NewServer()
+		c, _ := New(s.Addr(), 0, 10, WithProtocol(proto), WithMultiplex(1))
+		if err := c.Set(context.Background(), &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A flush without reply does not wait for a response.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		start := time.Now()
+		if err := c.FlushServer(ctx, s.Addr(), FlushAllOptions{NoReply: true}); err != nil || time.Since(start) > 500*time.Millisecond {
+			t.Errorf("protocol %d: FlushServer without reply = %v after %v", proto, err, time.Since(start))
+		}
+		cancel()
+		if err := c.FlushAll(context.Background(), FlushAllOptions{NoReply: true}); err != nil {
+			t.Errorf("protocol %d: FlushAll without reply = %v", proto, err)
+		}
+		var err error
+		for i := 0; i < 100; i++ {
+			if _, err = c.Get(context.Background(), "foo"); err == ErrCacheMiss {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err != ErrCacheMiss {
+			t.Errorf("protocol %d: Get after the flush = %v", proto, err)
+		}
+
+		c.Close()
+		s.Close()
+	}
+
+	// The server closing the connection on shutdown is not a failure.
+	s := memcachetest.NewServer()
+	defer s.Close()
+	s.EnableShutdown()
+	c, _ := New(s.Addr(), 0, 10, WithMultiplex(1))
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx, s.Addr()); err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+}
+
+func TestClientMultiplexTimeout(t *testing.T) {
+	for _, proto := range []Protocol{ProtocolText, ProtocolBinary} {
+		s := memcachetest.NewServer()
+		p := memcachetest.NewProxy(s.Addr())
+		c, _ := NewWithOptions(Options{Addrs: []string{p.Addr()}, Protocol: proto, Multiplex: 1, ReadTimeout: 50 * time.Millisecond})
+		if err := c.Set(context.Background(), &Item{Key: "foo", Value: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The commands whose response does not come in time give up, the
+		// others waiting behind them are still served.
+		p.SetLatency(30 * time.Millisecond)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				timeout := time.Second
+				if i%2 == 0 {
+					timeout = 10 * time.Millisecond
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				it, err := c.Get(ctx, "foo")
+				switch {
+				case i%2 == 0 && err != context.DeadlineExceeded:
+					t.Errorf("protocol %d: Get with a short timeout = %+v, %v", proto, it, err)
+				case i%2 == 1 && (err != nil || string(it.Value) != "bar"):
+					t.Errorf("protocol %d: Get = %+v, %v", proto, it, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		p.SetLatency(0)
+		if it, err := c.Get(context.Background(), "foo"); err != nil || string(it.Value) != "bar" {
+			t.Errorf("protocol %d: Get after the timeouts = %+v, %v", proto, it, err)
+		}
+		if n := p.Accepted(); n != 1 {
+			t.Errorf("protocol %d: %d connections accepted, want 1", proto, n)
+		}
+
+		// A connection whose server stops answering is closed once the
+		// read timeout has passed after the deadline of the command.
+		p.SetFault(memcachetest.Blackhole)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := c.Get(ctx, "foo"); err != context.DeadlineExceeded {
+			t.Errorf("protocol %d: Get through a blackhole = %v", proto, err)
+		}
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		p.SetFault(memcachetest.NoFault)
+		if it, err := c.Get(context.Background(), "foo"); err != nil || string(it.Value) != "bar" {
+			t.Errorf("protocol %d: Get after the blackhole = %+v, %v", proto, it, err)
+		}
+		if n := p.Accepted(); n != 2 {
+			t.Errorf("protocol %d: %d connections accepted, want 2", proto, n)
+		}
+
+		c.Close()
+		p.Close()
+		s.Close()
+	}
+}
+
+func TestDiscardText(t *testing.T) {
+	cmds := "gets a b\r\n" +
+		"set a 0 0 5\r\nhello\r\n" +
+		"set b 0 0 1 noreply\r\nx\r\n" +
+		"ms c 2 T0\r\nhi\r\n" +
+		"mg a v f\r\n" +
+		"mg missing v\r\n" +
+		"stats\r\n" +
+		"delete a\r\n"
+	responses := "VALUE a 0 5 1\r\nhello\r\nVALUE b 0 2 2\r\n\r\n\r\nEND\r\n" +
+		"STORED\r\n" +
+		"HD\r\n" +
+		"VA 3 f0\r\nEND\r\n" +
+		"EN\r\n" +
+		"STAT pid 1\r\nSTAT uptime 2\r\nEND\r\n" +
+		"DELETED\r\n"
+	r := bufio.NewReader(strings.NewReader(responses + "next"))
+	if err := discardText(r, []byte(cmds)); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := r.ReadString(0); rest != "next" {
+		t.Errorf("left after discarding: %q", rest)
+	}
+
+	if err := discardText(r, []byte("mg a v q\r\n")); err != errUndiscardable {
+		t.Errorf("discardText of a quiet command = %v", err)
+	}
+}
+
+func BenchmarkClientGetParallel(b *testing.B) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	for _, n := range []int{0, 1} {
+		b.Run(fmt.Sprintf("multiplex=%d", n), func(b *testing.B) {
+			c, _ := NewWithOptions(Options{Addrs: []string{s.Addr()}, PoolTimeout: time.Second, Multiplex: n})
+			defer c.Close()
+			c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")})
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := c.Get(ctx, "foo"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
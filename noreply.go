@@ -0,0 +1,312 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-kiss/net/pool"
+)
+
+// NoReplyError is the error the server reported for a noreply command. Key
+// is only known for the meta commands, it is base64 encoded for binary keys.
+type NoReplyError struct {
+	Key string
+	Err error
+}
+
+func (e NoReplyError) Error() string {
+	if e.Key == "" {
+		return e.Err.Error()
+	}
+	return e.Key + ": " + e.Err.Error()
+}
+
+// SyncError is returned by Sync if the server reported errors for some of
+// the noreply commands. The errors are in the order of the commands.
+type SyncError []NoReplyError
+
+func (e SyncError) Error() string {
+	errs := make([]string, len(e))
+	for i, err := range e {
+		errs[i] = err.Error()
+	}
+	return "memcache: noreply commands failed: " + strings.Join(errs, "; ")
+}
+
+// SetNoReply is like Set but does not wait for the server. The command is
+// buffered and sent with the next Sync at the latest. Sync must be called
+// before any command which waits for a response.
+func (c *Conn) SetNoReply(item *Item) error {
+	if !legalKey(item.Key) {
+		return ErrMalformedKey
+	}
+	if _, err := fmt.Fprintf(c.rw, "set %s %d %d %d noreply\r\n",
+		item.Key, item.Flags, item.Expiration, len(item.Value)); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(item.Value); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(crlf); err != nil {
+		return err
+	}
+	c.noreply = true
+	return nil
+}
+
+// DeleteNoReply is like Delete but does not wait for the server. Deleting
+// a missing key is not reported. See SetNoReply.
+func (c *Conn) DeleteNoReply(key string) error {
+	return c.writeNoReply("delete %s noreply\r\n", key)
+}
+
+// TouchNoReply is like Touch but does not wait for the server. Touching a
+// missing key is not reported. See SetNoReply.
+func (c *Conn) TouchNoReply(key string, seconds int32) error {
+	return c.writeNoReply("touch %s %d noreply\r\n", key, seconds)
+}
+
+func (c *Conn) writeNoReply(format, key string, args ...interface{}) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	if _, err := fmt.Fprintf(c.rw, format, append([]interface{}{key}, args...)...); err != nil {
+		return err
+	}
+	c.noreply = true
+	return nil
+}
+
+// MetaSetNoReply sends a meta set command in quiet mode, so the server only
+// answers if the item is not stored. See SetNoReply.
+func (c *Conn) MetaSetNoReply(opt MetaSetOptions) error {
+	if opt.Value == nil {
+		opt.Value = []byte{}
+	}
+	return c.metaNoReply("ms", stringfyKey(opt.Key, opt.BinaryKey), opt.marshal(), opt.Value)
+}
+
+// MetaDeleteNoReply sends a meta delete command in quiet mode. Deleting a
+// missing key is not reported. See SetNoReply.
+func (c *Conn) MetaDeleteNoReply(opt MetaDeletOptions) error {
+	return c.metaNoReply("md", stringfyKey(opt.Key, opt.BinaryKey), opt.marshal(), nil)
+}
+
+func (c *Conn) metaNoReply(cmd, key string, flags []metaFlag, data []byte) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	// The key is asked back to tell which command failed.
+	flags = append(flags, withQuiet(), withKey())
+	if err := c.writeMetaCmd(cmd, key, flags, data); err != nil {
+		return err
+	}
+	c.noreply = true
+	return nil
+}
+
+// Sync sends the buffered noreply commands and waits until the server has
+// processed them. The errors reported by the server are returned as a
+// SyncError, after which the connection can still be used.
+func (c *Conn) Sync() error {
+	if !c.noreply {
+		return nil
+	}
+	c.noreply = false
+
+	// Every command answers version, so it works with any server.
+	if _, err := c.rw.WriteString("version\r\n"); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	var errs SyncError
+	for {
+		line, err := c.rw.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(line, resultVersionPrefix) {
+			break
+		}
+		errs = append(errs, noReplyError(line))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// noReplyError parses the response line of a failed noreply command.
+func noReplyError(line []byte) NoReplyError {
+	switch {
+	case bytes.HasPrefix(line, resultClientErrorPrefix):
+		msg := line[len(resultClientErrorPrefix) : len(line)-2]
+		return NoReplyError{Err: errors.New("memcache: client error: " + string(msg))}
+	case bytes.HasPrefix(line, resultServerErrorPrefix):
+		msg := line[len(resultServerErrorPrefix) : len(line)-2]
+		return NoReplyError{Err: errors.New("memcache: server error: " + string(msg))}
+	}
+
+	fields := strings.Fields(string(line))
+	var e NoReplyError
+	switch fields[0] {
+	case "NS":
+		e.Err = ErrNotStored
+	case "EX":
+		e.Err = ErrCASConflict
+	case "NF":
+		e.Err = ErrCacheMiss
+	default:
+		e.Err = fmt.Errorf("memcache: unexpected response line: %q", line)
+		return e
+	}
+	for _, f := range fields[1:] {
+		if f[0] == 'k' {
+			e.Key = f[1:]
+		}
+	}
+	return e
+}
+
+// Pipeline sends noreply commands to the servers without waiting for
+// their responses, e.g. to warm a cache. The connection to a server is
+// taken from the pool on first use and held until Sync. The text protocol
+// is required.
+//
+// A Pipeline is not safe for concurrent use.
+type Pipeline struct {
+	c     *Client
+	ctx   context.Context
+	conns map[string]*pool.Conn
+}
+
+// Pipeline returns a new Pipeline. ctx bounds all of its commands.
+func (c *Client) Pipeline(ctx context.Context) *Pipeline {
+	return &Pipeline{c: c, ctx: ctx, conns: make(map[string]*pool.Conn)}
+}
+
+// Set queues a set command.
+func (p *Pipeline) Set(item *Item) error {
+	return p.do(item.Key, false, func(c *Conn) error {
+		return c.SetNoReply(item)
+	})
+}
+
+// Delete queues a delete command. Deleting a missing key is not reported.
+func (p *Pipeline) Delete(key string) error {
+	return p.do(key, false, func(c *Conn) error {
+		return c.DeleteNoReply(key)
+	})
+}
+
+// Touch queues a touch command. Touching a missing key is not reported.
+func (p *Pipeline) Touch(key string, seconds int32) error {
+	return p.do(key, false, func(c *Conn) error {
+		return c.TouchNoReply(key, seconds)
+	})
+}
+
+// MetaSet queues a quiet meta set command. Servers without the meta
+// commands fail with ErrNotSupported.
+func (p *Pipeline) MetaSet(opt MetaSetOptions) error {
+	return p.do(stringfyKey(opt.Key, opt.BinaryKey), true, func(c *Conn) error {
+		return c.MetaSetNoReply(opt)
+	})
+}
+
+// MetaDelete queues a quiet meta delete command. Servers without the meta
+// commands fail with ErrNotSupported.
+func (p *Pipeline) MetaDelete(opt MetaDeletOptions) error {
+	return p.do(stringfyKey(opt.Key, opt.BinaryKey), true, func(c *Conn) error {
+		return c.MetaDeleteNoReply(opt)
+	})
+}
+
+func (p *Pipeline) do(key string, meta bool, fn func(c *Conn) error) error {
+	if p.c.opts.Protocol != ProtocolText {
+		return ErrNotSupported
+	}
+
+	addr, err := p.c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+
+	if meta {
+		// The capabilities are probed over a connection of their own, the
+		// responses of the noreply commands queued on the connection of
+		// the pipeline could be mistaken for the version.
+		caps, err := p.c.Capabilities(p.ctx, addr)
+		if err != nil {
+			return err
+		}
+		if !caps.Meta {
+			return ErrNotSupported
+		}
+	}
+
+	mc, ok := p.conns[addr]
+	if !ok {
+		pl, ok := p.c.pools[addr]
+		if !ok {
+			return ErrNoServers
+		}
+		if mc, err = pl.Get(p.ctx); err != nil {
+			return err
+		}
+		p.conns[addr] = mc
+	}
+
+	pc := mc.C.(*pooledConn)
+	p.c.setDeadline(p.ctx, pc.nc)
+	err = fn(pc.c.(*Conn))
+	if !IsResumableErr(err) {
+		p.release(addr, err)
+	}
+	return err
+}
+
+// release returns the connection to addr to its pool.
+func (p *Pipeline) release(addr string, err error) {
+	put(p.c.pools[addr], p.conns[addr], err)
+	delete(p.conns, addr)
+}
+
+// Sync sends the queued commands and waits until the servers have
+// processed them. The errors reported by the servers are returned as a
+// MultiError of their SyncError. The connections are returned to the pool
+// and the Pipeline can be used again.
+func (p *Pipeline) Sync() error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(MultiError)
+	for addr, mc := range p.conns {
+		wg.Add(1)
+		go func(addr string, pc *pooledConn) {
+			defer wg.Done()
+			p.c.setDeadline(p.ctx, pc.nc)
+			if err := pc.c.(*Conn).Sync(); err != nil {
+				mu.Lock()
+				errs[addr] = err
+				mu.Unlock()
+			}
+		}(addr, mc.C.(*pooledConn))
+	}
+	wg.Wait()
+
+	for addr := range p.conns {
+		p.release(addr, errs[addr])
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
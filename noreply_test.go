@@ -0,0 +1,135 @@
+package memcache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestConnNoReply(t *testing.T) {
+	c := setup(t)
+
+	if err := c.Sync(); err != nil {
+		t.Errorf("Sync without commands: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		key := "noreply" + strconv.Itoa(i)
+		if err := c.SetNoReply(&Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.DeleteNoReply("noreply0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteNoReply("noreply-missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TouchNoReply("noreply1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetNoReply(&Item{Key: "bad key"}); err != ErrMalformedKey {
+		t.Errorf("SetNoReply of malformed key: %v", err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	if _, err := c.Get("noreply0"); err != ErrCacheMiss {
+		t.Errorf("Get of deleted key: %v", err)
+	}
+	if it, err := c.Get("noreply99"); err != nil || string(it.Value) != "noreply99" {
+		t.Errorf("Get = %+v, %v", it, err)
+	}
+
+	// Only the failed meta commands are answered, with their key.
+	c.MetaSetNoReply(MetaSetOptions{Key: "noreply1", Value: []byte("x"), Mode: MetaSetModeAdd})
+	c.MetaSetNoReply(MetaSetOptions{Key: "noreply2", Value: []byte("y")})
+	c.MetaDeleteNoReply(MetaDeletOptions{Key: "noreply-missing"})
+	c.MetaSetNoReply(MetaSetOptions{Key: "noreply-missing", Value: []byte("z"), Mode: MetaSetModeReplace})
+	err := c.Sync()
+	se, ok := err.(SyncError)
+	if !ok || len(se) != 2 {
+		t.Fatalf("Sync want SyncError of 2 commands, got %v", err)
+	}
+	if se[0].Key != "noreply1" || se[0].Err != ErrNotStored || se[1].Key != "noreply-missing" {
+		t.Errorf("Sync errors = %v", se)
+	}
+	if !IsResumableErr(err) {
+		t.Error("SyncError should be resumable")
+	}
+	if it, err := c.Get("noreply2"); err != nil || string(it.Value) != "y" {
+		t.Errorf("Get after Sync = %+v, %v", it, err)
+	}
+}
+
+func TestClientPipeline(t *testing.T) {
+	s1, s2 := memcachetest.NewServer(), memcachetest.NewServer()
+	defer s1.Close()
+	defer s2.Close()
+	ctx := context.Background()
+
+	c, _ := NewCluster([]string{s1.Addr(), s2.Addr()}, 0, 10)
+	defer c.Close()
+
+	p := c.Pipeline(ctx)
+	for i := 0; i < 200; i++ {
+		if err := p.Set(&Item{Key: "warm" + strconv.Itoa(i), Value: []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Touch("warm1", 100)
+	p.Delete("warm2")
+	p.MetaSet(MetaSetOptions{Key: "warm3", Value: []byte("w"), Mode: MetaSetModeAdd})
+	p.MetaDelete(MetaDeletOptions{Key: "warm4"})
+
+	err := p.Sync()
+	me, ok := err.(MultiError)
+	if !ok || len(me) != 1 {
+		t.Fatalf("Sync want the error of one server, got %v", err)
+	}
+	for _, err := range me {
+		if se, ok := err.(SyncError); !ok || len(se) != 1 || se[0].Key != "warm3" {
+			t.Errorf("Sync error = %v", err)
+		}
+	}
+	if n := s1.Len() + s2.Len(); n != 198 {
+		t.Errorf("%d items stored, want 198", n)
+	}
+	if st := c.PoolStats(); st.TotalConns != st.IdleConns {
+		t.Errorf("connections not returned to the pool: %+v", st)
+	}
+	if it, err := c.Get(ctx, "warm199"); err != nil || string(it.Value) != "v" {
+		t.Errorf("Get = %+v, %v", it, err)
+	}
+
+	// The pipeline can be reused.
+	p.Set(&Item{Key: "warm2", Value: []byte("again")})
+	if err := p.Sync(); err != nil {
+		t.Errorf("second Sync: %v", err)
+	}
+	if it, err := c.Get(ctx, "warm2"); err != nil || string(it.Value) != "again" {
+		t.Errorf("Get = %+v, %v", it, err)
+	}
+
+	s1.SetVersion("1.5.22")
+	old, _ := New(s1.Addr(), 0, 10)
+	defer old.Close()
+	p = old.Pipeline(ctx)
+	if err := p.MetaSet(MetaSetOptions{Key: "foo"}); err != ErrNotSupported {
+		t.Errorf("MetaSet on old server: %v", err)
+	}
+	if err := p.Set(&Item{Key: "foo"}); err != nil {
+		t.Errorf("Set on old server: %v", err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Errorf("Sync on old server: %v", err)
+	}
+
+	bc, _ := New(s1.Addr(), 0, 10, WithProtocol(ProtocolBinary))
+	defer bc.Close()
+	if err := bc.Pipeline(ctx).Set(&Item{Key: "foo"}); err != ErrNotSupported {
+		t.Errorf("binary Pipeline: %v", err)
+	}
+}
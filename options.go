@@ -0,0 +1,204 @@
+package memcache
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// Protocol is the wire protocol spoken by a Client.
+type Protocol int
+
+const (
+	// ProtocolText is the text protocol, including the meta commands.
+	ProtocolText Protocol = iota
+	// ProtocolBinary is the binary protocol.
+	ProtocolBinary
+)
+
+const (
+	defaultPoolSize   = 10
+	defaultBufferSize = 4096
+)
+
+// Options configures a Client created by NewWithOptions. The zero value of
+// every field except the servers is a usable default.
+type Options struct {
+	// Addrs are the addresses of the servers. Keys are sharded over them
+	// with a ketama-compatible consistent hash. Ignored if Selector is set.
+	Addrs []string
+	// Selector shards keys over the servers it returns.
+	Selector ServerSelector
+
+	// Protocol is the wire protocol, the text protocol by default. The
+	// meta commands are only available with it.
+	Protocol Protocol
+	// MetaFallback makes the meta get and set commands fall back to the
+	// classic commands on servers without the meta commands, as far as
+	// their options can be expressed with them.
+	MetaFallback bool
+	// Username and Password are the SASL PLAIN credentials every new
+	// connection is authenticated with. SASL requires the binary protocol.
+	Username string
+	Password string
+	// TLSConfig makes the client connect to the servers over TLS. Client
+	// certificates are taken from it. If it has no ServerName, the host of
+	// the server address is used for SNI and certificate verification.
+	TLSConfig *tls.Config
+	// Dialer replaces the dialer used to connect to the servers. It is
+	// called with the server address as configured in the client.
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// DialTimeout bounds connecting to a server, including the TLS
+	// handshake and the SASL authentication. Zero means no timeout.
+	DialTimeout time.Duration
+	// ReadTimeout and WriteTimeout bound reading and writing a command
+	// whose ctx has no deadline. Zero means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// PoolSize is the maximum number of connections to every server, 10
+	// by default.
+	PoolSize int
+	// MinIdleConns is the number of idle connections kept open to every
+	// server.
+	MinIdleConns int
+	// PoolTimeout is how long a command waits for a connection when the
+	// pool is exhausted. Zero means failing at once.
+	PoolTimeout time.Duration
+	// IdleTimeout is how long a connection may stay idle before it is
+	// closed. Zero means idle connections are never closed.
+	IdleTimeout time.Duration
+	// MaxConnAge is how long a connection is used before it is closed.
+	// Zero means connections are never closed for their age.
+	MaxConnAge time.Duration
+	// IdleCheckFrequency is how often idle connections are checked and
+	// closed in the background. Zero means they are only closed when taken
+	// from the pool.
+	IdleCheckFrequency time.Duration
+	// Multiplex is the number of connections to every server shared by
+	// the commands of all goroutines. The commands are written in batches
+	// and their responses read in order, so a few connections serve many
+	// goroutines. A command whose ctx is done while its response is
+	// pending gives up, its response is discarded when it comes. Zero
+	// means every command takes a connection of the pool, which Pipeline,
+	// MetaBatch, the admin commands and the streaming GetTo and SetFrom
+	// always do.
+	Multiplex int
+
+	// ReadBufferSize and WriteBufferSize are the buffer sizes of every
+	// connection, 4096 bytes by default. The read buffer must hold the
+	// longest response line, which includes the key.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// ValuePool makes the text protocol read values into buffers taken
+	// from a pool. Item.Release and MetaResult.Release return them once
+	// the value is not needed anymore, which saves allocations for
+	// clients reading many values.
+	ValuePool bool
+}
+
+// init validates o and fills in the defaults.
+func (o *Options) init() error {
+	if o.Selector == nil {
+		o.Selector = NewKetamaSelector(o.Addrs)
+	}
+	if len(o.Selector.Servers()) == 0 {
+		return ErrNoServers
+	}
+
+	switch {
+	case o.Protocol != ProtocolText && o.Protocol != ProtocolBinary:
+		return errors.New("memcache: unknown protocol")
+	case o.Username != "" && o.Protocol != ProtocolBinary:
+		return errors.New("memcache: SASL authentication requires the binary protocol")
+	case o.DialTimeout < 0, o.ReadTimeout < 0, o.WriteTimeout < 0,
+		o.PoolTimeout < 0, o.IdleTimeout < 0, o.MaxConnAge < 0,
+		o.IdleCheckFrequency < 0:
+		return errors.New("memcache: negative timeout")
+	case o.PoolSize < 0, o.MinIdleConns < 0, o.Multiplex < 0:
+		return errors.New("memcache: negative pool size")
+	case o.ReadBufferSize < 0, o.WriteBufferSize < 0:
+		return errors.New("memcache: negative buffer size")
+	}
+
+	if o.PoolSize == 0 {
+		o.PoolSize = defaultPoolSize
+	}
+	if o.MinIdleConns > o.PoolSize {
+		return errors.New("memcache: MinIdleConns exceeds PoolSize")
+	}
+	if o.ReadBufferSize == 0 {
+		o.ReadBufferSize = defaultBufferSize
+	}
+	if o.WriteBufferSize == 0 {
+		o.WriteBufferSize = defaultBufferSize
+	}
+
+	return nil
+}
+
+// Option configures a Client.
+type Option func(*Options)
+
+// WithProtocol selects the wire protocol of the client. The text protocol
+// is used by default. The meta commands are only available with it.
+func WithProtocol(p Protocol) Option {
+	return func(o *Options) {
+		o.Protocol = p
+	}
+}
+
+// WithMetaFallback makes MetaGet and MetaSet fall back to the classic
+// get, gets, gat, gats, touch and storage commands on servers without the
+// meta commands.
+func WithMetaFallback() Option {
+	return func(o *Options) {
+		o.MetaFallback = true
+	}
+}
+
+// WithValuePool makes the client read values into pooled buffers, see
+// Options.ValuePool.
+func WithValuePool() Option {
+	return func(o *Options) {
+		o.ValuePool = true
+	}
+}
+
+// WithMultiplex makes the commands of all goroutines share n connections
+// to every server, see Options.Multiplex.
+func WithMultiplex(n int) Option {
+	return func(o *Options) {
+		o.Multiplex = n
+	}
+}
+
+// WithSASL makes the client authenticate every new connection with SASL
+// PLAIN before using it. SASL requires the binary protocol.
+func WithSASL(username, password string) Option {
+	return func(o *Options) {
+		o.Username = username
+		o.Password = password
+	}
+}
+
+// WithTLS makes the client connect to the servers over TLS. Client
+// certificates are taken from cfg. If cfg has no ServerName, the host of
+// the server address is used for SNI and certificate verification.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *Options) {
+		o.TLSConfig = cfg
+	}
+}
+
+// WithDialer replaces the dialer used to connect to the servers, e.g. to
+// tunnel connections through a proxy or to use in-memory connections in
+// tests. It is called with the server address as configured in the client.
+func WithDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(o *Options) {
+		o.Dialer = dial
+	}
+}
@@ -0,0 +1,120 @@
+package memcache
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptionsValidation(t *testing.T) {
+	addrs := []string{os.Getenv("MC_ADDRESS")}
+	cases := []struct {
+		name string
+		o    Options
+	}{
+		{"no servers", Options{}},
+		{"unknown protocol", Options{Addrs: addrs, Protocol: 2}},
+		{"sasl over text", Options{Addrs: addrs, Username: "u"}},
+		{"negative dial timeout", Options{Addrs: addrs, DialTimeout: -1}},
+		{"negative read timeout", Options{Addrs: addrs, ReadTimeout: -1}},
+		{"negative pool size", Options{Addrs: addrs, PoolSize: -1}},
+		{"min idle exceeds pool", Options{Addrs: addrs, PoolSize: 2, MinIdleConns: 3}},
+		{"min idle exceeds default pool", Options{Addrs: addrs, MinIdleConns: defaultPoolSize + 1}},
+		{"negative buffer size", Options{Addrs: addrs, ReadBufferSize: -1}},
+	}
+	for _, c := range cases {
+		if _, err := NewWithOptions(c.o); err == nil {
+			t.Errorf("%s: NewWithOptions should fail", c.name)
+		}
+	}
+
+	if _, err := New(addrs[0], 3, 2); err == nil {
+		t.Error("New with initialCap > maxCap should fail")
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	c, err := NewWithOptions(Options{
+		Addrs:           []string{os.Getenv("MC_ADDRESS")},
+		DialTimeout:     time.Second,
+		ReadTimeout:     time.Second,
+		WriteTimeout:    time.Second,
+		PoolTimeout:     time.Second,
+		IdleTimeout:     time.Minute,
+		MaxConnAge:      time.Hour,
+		ReadBufferSize:  512,
+		WriteBufferSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	value := make([]byte, 10000)
+	if err := c.Set(ctx, &Item{Key: "foo", Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := c.Get(ctx, "foo"); err != nil || len(item.Value) != len(value) {
+		t.Fatalf("Get = %+v, %v", item, err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	// The server accepts connections but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	c, err := NewWithOptions(Options{
+		Addrs:       []string{ln.Addr().String()},
+		ReadTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	_, err = c.Get(context.Background(), "foo")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Get want timeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Get took %v", d)
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	c, err := NewWithOptions(Options{
+		Addrs:       []string{os.Getenv("MC_ADDRESS")},
+		PoolSize:    1,
+		PoolTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	err = c.do(ctx, "foo", func(conn) error {
+		_, err := c.Get(ctx, "foo")
+		return err
+	})
+	if err == nil {
+		t.Error("Get on exhausted pool should time out")
+	}
+}
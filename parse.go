@@ -0,0 +1,78 @@
+package memcache
+
+import (
+	"errors"
+	"math"
+)
+
+// The response lines are parsed in place, the helpers below work on the
+// bytes of the line without converting them to strings.
+
+var errMalformedNumber = errors.New("memcache: malformed number in response")
+
+// nextToken splits b at the first space into the token before it and the
+// rest after it. Repeated spaces are skipped.
+func nextToken(b []byte) (tok, rest []byte) {
+	for len(b) > 0 && b[0] == ' ' {
+		b = b[1:]
+	}
+	for i, c := range b {
+		if c == ' ' {
+			return b[:i], b[i+1:]
+		}
+	}
+	return b, nil
+}
+
+// parseUint parses the decimal number b, failing on overflow.
+func parseUint(b []byte) (uint64, error) {
+	if len(b) == 0 {
+		return 0, errMalformedNumber
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, errMalformedNumber
+		}
+		d := uint64(c - '0')
+		if n > (math.MaxUint64-d)/10 {
+			return 0, errMalformedNumber
+		}
+		n = n*10 + d
+	}
+	return n, nil
+}
+
+// parseUint32 is parseUint for numbers which must fit into 32 bits.
+func parseUint32(b []byte) (uint32, error) {
+	n, err := parseUint(b)
+	if err != nil || n > math.MaxUint32 {
+		return 0, errMalformedNumber
+	}
+	return uint32(n), nil
+}
+
+// parseInt parses the decimal number b, which may be negative.
+func parseInt(b []byte) (int64, error) {
+	neg := len(b) > 0 && b[0] == '-'
+	if neg {
+		b = b[1:]
+	}
+	n, err := parseUint(b)
+	if err != nil || n > math.MaxInt64 {
+		return 0, errMalformedNumber
+	}
+	if neg {
+		return -int64(n), nil
+	}
+	return int64(n), nil
+}
+
+// parseSize parses the size of a value, which must fit into an int.
+func parseSize(b []byte) (int, error) {
+	n, err := parseUint(b)
+	if err != nil || n > math.MaxInt32 {
+		return 0, errMalformedNumber
+	}
+	return int(n), nil
+}
@@ -0,0 +1,117 @@
+package memcache
+
+import (
+	"crypto/md5"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// ErrNoServers is returned when no servers are configured or available.
+var ErrNoServers = errors.New("memcache: no servers configured or available")
+
+// ServerSelector is the interface that selects a memcache server
+// as a function of the item's key.
+//
+// All ServerSelector implementations must be safe for concurrent use
+// by multiple goroutines.
+type ServerSelector interface {
+	// PickServer returns the address of the server that a given item
+	// should be sharded onto.
+	PickServer(key string) (string, error)
+
+	// Servers returns the addresses of all configured servers.
+	Servers() []string
+}
+
+const (
+	ketamaPointsPerServer = 160
+	ketamaPointsPerHash   = 4
+	ketamaDefaultPort     = "11211"
+)
+
+type ketamaPoint struct {
+	hash uint32
+	addr string
+}
+
+// KetamaSelector is a ServerSelector which places servers on the weighted
+// ketama continuum of libmemcached (MEMCACHED_BEHAVIOR_KETAMA_WEIGHTED) with
+// equal weights: 160 points per server, 4 from every MD5 digest of
+// "host-N", where host includes the port unless it is the default 11211.
+// libketama builds the same continuum if no server has the default port.
+// The same key then maps to the same server as in those clients.
+type KetamaSelector struct {
+	addrs  []string
+	points []ketamaPoint
+}
+
+// NewKetamaSelector returns a KetamaSelector for the given server addresses.
+func NewKetamaSelector(addrs []string) *KetamaSelector {
+	ks := &KetamaSelector{addrs: append([]string(nil), addrs...)}
+	if len(addrs) < 2 {
+		return ks
+	}
+
+	ks.points = make([]ketamaPoint, 0, len(addrs)*ketamaPointsPerServer)
+	for _, addr := range addrs {
+		name := ketamaName(addr)
+		for i := 0; i < ketamaPointsPerServer/ketamaPointsPerHash; i++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for h := 0; h < ketamaPointsPerHash; h++ {
+				ks.points = append(ks.points, ketamaPoint{
+					hash: ketamaHash(digest, h),
+					addr: addr,
+				})
+			}
+		}
+	}
+	sort.Slice(ks.points, func(i, j int) bool {
+		return ks.points[i].hash < ks.points[j].hash
+	})
+
+	return ks
+}
+
+// ketamaName returns the name libmemcached uses for addr when building the
+// continuum: the port is omitted when it is the default one.
+func ketamaName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != ketamaDefaultPort {
+		return addr
+	}
+	return host
+}
+
+func ketamaHash(digest [md5.Size]byte, h int) uint32 {
+	return uint32(digest[3+h*4])<<24 |
+		uint32(digest[2+h*4])<<16 |
+		uint32(digest[1+h*4])<<8 |
+		uint32(digest[h*4])
+}
+
+// PickServer implements ServerSelector.
+func (ks *KetamaSelector) PickServer(key string) (string, error) {
+	switch len(ks.addrs) {
+	case 0:
+		return "", ErrNoServers
+	case 1:
+		return ks.addrs[0], nil
+	}
+
+	hash := ketamaHash(md5.Sum([]byte(key)), 0)
+	i := sort.Search(len(ks.points), func(i int) bool {
+		return ks.points[i].hash >= hash
+	})
+	if i == len(ks.points) {
+		i = 0
+	}
+
+	return ks.points[i].addr, nil
+}
+
+// Servers implements ServerSelector.
+func (ks *KetamaSelector) Servers() []string {
+	return ks.addrs
+}
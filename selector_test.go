@@ -0,0 +1,106 @@
+package memcache
+
+import (
+	"bufio"
+	"crypto/md5"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKetamaSelector(t *testing.T) {
+	if _, err := NewKetamaSelector(nil).PickServer("foo"); err != ErrNoServers {
+		t.Errorf("PickServer without servers want ErrNoServers, got %v", err)
+	}
+
+	ks := NewKetamaSelector([]string{"10.0.0.1:11211"})
+	if addr, _ := ks.PickServer("foo"); addr != "10.0.0.1:11211" {
+		t.Errorf("PickServer with one server got %q", addr)
+	}
+
+	addrs := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11212"}
+	ks = NewKetamaSelector(addrs)
+	if n := len(ks.points); n != len(addrs)*ketamaPointsPerServer {
+		t.Fatalf("continuum has %d points, want %d", n, len(addrs)*ketamaPointsPerServer)
+	}
+
+	counts := make(map[string]int)
+	picked := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := "key" + strconv.Itoa(i)
+		addr, err := ks.PickServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := ks.PickServer(key); again != addr {
+			t.Fatalf("PickServer(%q) is not stable: %q then %q", key, addr, again)
+		}
+		counts[addr]++
+		picked[key] = addr
+	}
+	for _, addr := range addrs {
+		if counts[addr] < 500 {
+			t.Errorf("server %s got %d of 3000 keys", addr, counts[addr])
+		}
+	}
+
+	// Removing a server must only move the keys it owned.
+	ks = NewKetamaSelector(addrs[:2])
+	for key, was := range picked {
+		addr, _ := ks.PickServer(key)
+		if was != addrs[2] && addr != was {
+			t.Fatalf("key %q moved from %s to %s", key, was, addr)
+		}
+	}
+}
+
+func TestKetamaName(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1:11211": "10.0.0.1",
+		"10.0.0.1:11212": "10.0.0.1:11212",
+		"cache:11211":    "cache",
+	}
+	for addr, want := range cases {
+		if got := ketamaName(addr); got != want {
+			t.Errorf("ketamaName(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestKetamaSelectorVectors(t *testing.T) {
+	// A key hashes to the first 4 bytes of its MD5 digest, little endian:
+	// d41d8cd9 for the empty key (RFC 1321).
+	if h := ketamaHash(md5.Sum(nil), 0); h != 0xd98c1dd4 {
+		t.Errorf("ketamaHash of the empty key = %#x", h)
+	}
+}
+
+// TestKetamaSelectorLibmemcached compares the servers picked with the ones
+// libmemcached picks, as written by testdata/ketama/gen.c to
+// testdata/ketama/libmemcached.txt.
+func TestKetamaSelectorLibmemcached(t *testing.T) {
+	f, err := os.Open("testdata/ketama/libmemcached.txt")
+	if os.IsNotExist(err) {
+		t.Skip("no servers picked by libmemcached, see testdata/ketama/gen.c")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ks := NewKetamaSelector([]string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11212"})
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			t.Fatalf("malformed line %q", sc.Text())
+		}
+		if addr, _ := ks.PickServer(fields[0]); addr != fields[1] {
+			t.Errorf("PickServer(%q) = %s, libmemcached picks %s", fields[0], addr, fields[1])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,393 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats maps the names of the statistics reported by a server to their raw
+// values. General, Settings, Slabs, Items and Conns parse them into typed
+// structs, depending on the arguments of the stats command.
+type Stats map[string]string
+
+// Stats returns the statistics selected by args, e.g. "settings", "slabs",
+// "items" or "conns", or the general statistics without args.
+func (c *Conn) Stats(args ...string) (Stats, error) {
+	cmd := "stats"
+	if len(args) > 0 {
+		cmd += " " + strings.Join(args, " ")
+	}
+	if _, err := fmt.Fprintf(c.rw, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	stats := make(Stats)
+	for {
+		line, err := c.rw.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case bytes.Equal(line, resultEnd), bytes.Equal(line, resultOk), bytes.Equal(line, resultReset):
+			return stats, nil
+		case bytes.HasPrefix(line, resultStatPrefix):
+			kv := strings.SplitN(string(line[len(resultStatPrefix):len(line)-2]), " ", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("memcache: unexpected line in stats response: %q", line)
+			}
+			stats[kv[0]] = kv[1]
+		case bytes.HasPrefix(line, resultClientErrorPrefix):
+			return nil, fmt.Errorf("memcache: client error: %s", line[len(resultClientErrorPrefix):len(line)-2])
+		default:
+			return nil, fmt.Errorf("memcache: unexpected line in stats response: %q", line)
+		}
+	}
+}
+
+// Stats returns the statistics selected by args of every server, keyed by
+// server address. If some servers fail, the statistics of the others are
+// still returned together with a MultiError.
+func (c *Client) Stats(ctx context.Context, args ...string) (map[string]Stats, error) {
+	var mu sync.Mutex
+	stats := make(map[string]Stats)
+	err := c.doServers(ctx, c.Servers(), func(addr string, c conn) error {
+		s, err := c.Stats(args...)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		stats[addr] = s
+		mu.Unlock()
+		return nil
+	})
+
+	return stats, err
+}
+
+func (s Stats) int(name string) int64 {
+	v, _ := strconv.ParseInt(s[name], 10, 64)
+	return v
+}
+
+func (s Stats) uint(name string) uint64 {
+	v, _ := strconv.ParseUint(s[name], 10, 64)
+	return v
+}
+
+func (s Stats) float(name string) float64 {
+	v, _ := strconv.ParseFloat(s[name], 64)
+	return v
+}
+
+func (s Stats) bool(name string) bool {
+	switch s[name] {
+	case "yes", "on", "true", "1":
+		return true
+	}
+	return false
+}
+
+func (s Stats) seconds(name string) time.Duration {
+	return time.Duration(s.int(name)) * time.Second
+}
+
+// sub returns the statistics named prefix:id:name as a map from id to the
+// statistics named name.
+func (s Stats) sub(prefix string) map[int]Stats {
+	m := make(map[int]Stats)
+	for k, v := range s {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		parts := strings.SplitN(k[len(prefix):], ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		if m[id] == nil {
+			m[id] = make(Stats)
+		}
+		m[id][parts[1]] = v
+	}
+	return m
+}
+
+// GeneralStats are the general statistics of a server.
+type GeneralStats struct {
+	PID              int64
+	Uptime           time.Duration
+	Time             time.Time
+	Version          string
+	CurrConnections  uint64
+	TotalConnections uint64
+	CurrItems        uint64
+	TotalItems       uint64
+	Bytes            uint64
+	LimitMaxBytes    uint64
+	Threads          uint64
+	Evictions        uint64
+	Reclaimed        uint64
+	BytesRead        uint64
+	BytesWritten     uint64
+
+	CmdGet   uint64
+	CmdSet   uint64
+	CmdFlush uint64
+	CmdTouch uint64
+
+	GetHits      uint64
+	GetMisses    uint64
+	GetExpired   uint64
+	DeleteHits   uint64
+	DeleteMisses uint64
+	IncrHits     uint64
+	IncrMisses   uint64
+	DecrHits     uint64
+	DecrMisses   uint64
+	CASHits      uint64
+	CASMisses    uint64
+	CASBadval    uint64
+	TouchHits    uint64
+	TouchMisses  uint64
+}
+
+// General parses the general statistics, returned by stats without
+// arguments.
+func (s Stats) General() GeneralStats {
+	return GeneralStats{
+		PID:              s.int("pid"),
+		Uptime:           s.seconds("uptime"),
+		Time:             time.Unix(s.int("time"), 0),
+		Version:          s["version"],
+		CurrConnections:  s.uint("curr_connections"),
+		TotalConnections: s.uint("total_connections"),
+		CurrItems:        s.uint("curr_items"),
+		TotalItems:       s.uint("total_items"),
+		Bytes:            s.uint("bytes"),
+		LimitMaxBytes:    s.uint("limit_maxbytes"),
+		Threads:          s.uint("threads"),
+		Evictions:        s.uint("evictions"),
+		Reclaimed:        s.uint("reclaimed"),
+		BytesRead:        s.uint("bytes_read"),
+		BytesWritten:     s.uint("bytes_written"),
+
+		CmdGet:   s.uint("cmd_get"),
+		CmdSet:   s.uint("cmd_set"),
+		CmdFlush: s.uint("cmd_flush"),
+		CmdTouch: s.uint("cmd_touch"),
+
+		GetHits:      s.uint("get_hits"),
+		GetMisses:    s.uint("get_misses"),
+		GetExpired:   s.uint("get_expired"),
+		DeleteHits:   s.uint("delete_hits"),
+		DeleteMisses: s.uint("delete_misses"),
+		IncrHits:     s.uint("incr_hits"),
+		IncrMisses:   s.uint("incr_misses"),
+		DecrHits:     s.uint("decr_hits"),
+		DecrMisses:   s.uint("decr_misses"),
+		CASHits:      s.uint("cas_hits"),
+		CASMisses:    s.uint("cas_misses"),
+		CASBadval:    s.uint("cas_badval"),
+		TouchHits:    s.uint("touch_hits"),
+		TouchMisses:  s.uint("touch_misses"),
+	}
+}
+
+func ratio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// GetHitRatio returns the share of the fetched keys that were found.
+func (s GeneralStats) GetHitRatio() float64 {
+	return ratio(s.GetHits, s.GetMisses)
+}
+
+// DeleteHitRatio returns the share of the deleted keys that were found.
+func (s GeneralStats) DeleteHitRatio() float64 {
+	return ratio(s.DeleteHits, s.DeleteMisses)
+}
+
+// IncrHitRatio returns the share of the incremented keys that were found.
+func (s GeneralStats) IncrHitRatio() float64 {
+	return ratio(s.IncrHits, s.IncrMisses)
+}
+
+// DecrHitRatio returns the share of the decremented keys that were found.
+func (s GeneralStats) DecrHitRatio() float64 {
+	return ratio(s.DecrHits, s.DecrMisses)
+}
+
+// CASHitRatio returns the share of the compare-and-swap commands that were
+// stored.
+func (s GeneralStats) CASHitRatio() float64 {
+	return ratio(s.CASHits, s.CASMisses+s.CASBadval)
+}
+
+// TouchHitRatio returns the share of the touched keys that were found.
+func (s GeneralStats) TouchHitRatio() float64 {
+	return ratio(s.TouchHits, s.TouchMisses)
+}
+
+// Settings are the settings of a server, returned by stats settings.
+type Settings struct {
+	MaxBytes     uint64
+	MaxConns     uint64
+	TCPPort      uint64
+	UDPPort      uint64
+	Verbosity    uint64
+	Evictions    bool
+	GrowthFactor float64
+	ChunkSize    uint64
+	NumThreads   uint64
+	CASEnabled   bool
+	ItemSizeMax  uint64
+}
+
+// Settings parses the settings, returned by stats settings.
+func (s Stats) Settings() Settings {
+	return Settings{
+		MaxBytes:     s.uint("maxbytes"),
+		MaxConns:     s.uint("maxconns"),
+		TCPPort:      s.uint("tcpport"),
+		UDPPort:      s.uint("udpport"),
+		Verbosity:    s.uint("verbosity"),
+		Evictions:    s.bool("evictions"),
+		GrowthFactor: s.float("growth_factor"),
+		ChunkSize:    s.uint("chunk_size"),
+		NumThreads:   s.uint("num_threads"),
+		CASEnabled:   s.bool("cas_enabled"),
+		ItemSizeMax:  s.uint("item_size_max"),
+	}
+}
+
+// SlabStats are the statistics of a slab class.
+type SlabStats struct {
+	ChunkSize     uint64
+	ChunksPerPage uint64
+	TotalPages    uint64
+	TotalChunks   uint64
+	UsedChunks    uint64
+	FreeChunks    uint64
+	FreeChunksEnd uint64
+	MemRequested  uint64
+	GetHits       uint64
+	CmdSet        uint64
+	DeleteHits    uint64
+	IncrHits      uint64
+	DecrHits      uint64
+	CASHits       uint64
+	CASBadval     uint64
+	TouchHits     uint64
+}
+
+// SlabsStats are the statistics returned by stats slabs.
+type SlabsStats struct {
+	// Slabs maps the slab class ids to their statistics.
+	Slabs         map[int]SlabStats
+	ActiveSlabs   uint64
+	TotalMalloced uint64
+}
+
+// Slabs parses the statistics returned by stats slabs.
+func (s Stats) Slabs() SlabsStats {
+	ss := SlabsStats{
+		Slabs:         make(map[int]SlabStats),
+		ActiveSlabs:   s.uint("active_slabs"),
+		TotalMalloced: s.uint("total_malloced"),
+	}
+	for id, s := range s.sub("") {
+		ss.Slabs[id] = SlabStats{
+			ChunkSize:     s.uint("chunk_size"),
+			ChunksPerPage: s.uint("chunks_per_page"),
+			TotalPages:    s.uint("total_pages"),
+			TotalChunks:   s.uint("total_chunks"),
+			UsedChunks:    s.uint("used_chunks"),
+			FreeChunks:    s.uint("free_chunks"),
+			FreeChunksEnd: s.uint("free_chunks_end"),
+			MemRequested:  s.uint("mem_requested"),
+			GetHits:       s.uint("get_hits"),
+			CmdSet:        s.uint("cmd_set"),
+			DeleteHits:    s.uint("delete_hits"),
+			IncrHits:      s.uint("incr_hits"),
+			DecrHits:      s.uint("decr_hits"),
+			CASHits:       s.uint("cas_hits"),
+			CASBadval:     s.uint("cas_badval"),
+			TouchHits:     s.uint("touch_hits"),
+		}
+	}
+	return ss
+}
+
+// ItemStats are the statistics of the items of a slab class.
+type ItemStats struct {
+	Number           uint64
+	Age              time.Duration
+	Evicted          uint64
+	EvictedNonzero   uint64
+	EvictedTime      time.Duration
+	OutOfMemory      uint64
+	TailRepairs      uint64
+	Reclaimed        uint64
+	ExpiredUnfetched uint64
+	EvictedUnfetched uint64
+	MemRequested     uint64
+}
+
+// Items parses the statistics returned by stats items. It maps the slab
+// class ids to the statistics of their items.
+func (s Stats) Items() map[int]ItemStats {
+	items := make(map[int]ItemStats)
+	for id, s := range s.sub("items:") {
+		items[id] = ItemStats{
+			Number:           s.uint("number"),
+			Age:              s.seconds("age"),
+			Evicted:          s.uint("evicted"),
+			EvictedNonzero:   s.uint("evicted_nonzero"),
+			EvictedTime:      s.seconds("evicted_time"),
+			OutOfMemory:      s.uint("outofmemory"),
+			TailRepairs:      s.uint("tailrepairs"),
+			Reclaimed:        s.uint("reclaimed"),
+			ExpiredUnfetched: s.uint("expired_unfetched"),
+			EvictedUnfetched: s.uint("evicted_unfetched"),
+			MemRequested:     s.uint("mem_requested"),
+		}
+	}
+	return items
+}
+
+// ConnStats are the statistics of a client connection.
+type ConnStats struct {
+	Addr         string
+	ListenAddr   string
+	State        string
+	SinceLastCmd time.Duration
+}
+
+// Conns parses the statistics returned by stats conns. It maps the file
+// descriptors of the connections to their statistics.
+func (s Stats) Conns() map[int]ConnStats {
+	conns := make(map[int]ConnStats)
+	for fd, s := range s.sub("") {
+		conns[fd] = ConnStats{
+			Addr:         s["addr"],
+			ListenAddr:   s["listen_addr"],
+			State:        s["state"],
+			SinceLastCmd: s.seconds("secs_since_last_cmd"),
+		}
+	}
+	return conns
+}
@@ -0,0 +1,172 @@
+package memcache
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+func TestConnStats(t *testing.T) {
+	c := setup(t)
+
+	before, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(&Item{Key: "foo", Value: []byte("bar")})
+	c.Get("foo")
+	c.Get("stats-missing")
+	after, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, a := before.General(), after.General()
+	if a.Version == "" || a.Uptime < 0 || a.Time.IsZero() {
+		t.Errorf("General = %+v", a)
+	}
+	if a.GetHits < b.GetHits+1 || a.GetMisses < b.GetMisses+1 || a.CmdSet < b.CmdSet+1 {
+		t.Errorf("counters did not grow: before %+v, after %+v", b, a)
+	}
+	if r := a.GetHitRatio(); r <= 0 || r >= 1 {
+		t.Errorf("GetHitRatio = %v", r)
+	}
+
+	s, err := c.Stats("settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Settings(); st.MaxBytes == 0 || st.GrowthFactor == 0 {
+		t.Errorf("Settings = %+v", st)
+	}
+
+	s, err = c.Stats("slabs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slabs := s.Slabs()
+	if slabs.ActiveSlabs == 0 || len(slabs.Slabs) == 0 {
+		t.Errorf("Slabs = %+v", slabs)
+	}
+	for id, slab := range slabs.Slabs {
+		if slab.ChunkSize == 0 || slab.UsedChunks == 0 {
+			t.Errorf("slab %d = %+v", id, slab)
+		}
+	}
+
+	s, err = c.Stats("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := s.Items()
+	if len(items) == 0 {
+		t.Error("Items is empty")
+	}
+	for id, item := range items {
+		if item.Number == 0 {
+			t.Errorf("items %d = %+v", id, item)
+		}
+	}
+
+	s, err = c.Stats("conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conns := s.Conns(); len(conns) == 0 {
+		t.Error("Conns is empty")
+	}
+
+	if _, err := c.Stats("bogus"); err == nil {
+		t.Error("Stats of unknown group should fail")
+	}
+	if err := c.ping(); err != nil {
+		t.Errorf("connection unusable after stats: %v", err)
+	}
+}
+
+func TestStatsParse(t *testing.T) {
+	s := Stats{
+		"uptime":      "90",
+		"time":        "1700000000",
+		"get_hits":    "3",
+		"get_misses":  "1",
+		"cas_hits":    "1",
+		"cas_badval":  "1",
+		"evictions":   "on",
+		"1:cmd_set":   "7",
+		"12:cmd_set":  "2",
+		"items:5:age": "60",
+		"7:state":     "conn_parse_cmd",
+		"7:addr":      "tcp:127.0.0.1:4242",
+	}
+
+	g := s.General()
+	if g.Uptime != 90*time.Second || g.Time.Unix() != 1700000000 {
+		t.Errorf("General = %+v", g)
+	}
+	if g.GetHitRatio() != 0.75 || g.CASHitRatio() != 0.5 || g.TouchHitRatio() != 0 {
+		t.Errorf("ratios = %v %v %v", g.GetHitRatio(), g.CASHitRatio(), g.TouchHitRatio())
+	}
+	if !s.Settings().Evictions {
+		t.Error("Settings.Evictions = false")
+	}
+	if slabs := s.Slabs().Slabs; slabs[1].CmdSet != 7 || slabs[12].CmdSet != 2 {
+		t.Errorf("Slabs = %+v", slabs)
+	}
+	if items := s.Items(); len(items) != 1 || items[5].Age != time.Minute {
+		t.Errorf("Items = %+v", items)
+	}
+	if c := s.Conns()[7]; c.State != "conn_parse_cmd" || c.Addr != "tcp:127.0.0.1:4242" {
+		t.Errorf("Conns = %+v", c)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		s := memcachetest.NewServer()
+		defer s.Close()
+		addrs = append(addrs, s.Addr())
+	}
+	dead := "127.0.0.1:1"
+
+	for _, p := range []Protocol{ProtocolText, ProtocolBinary} {
+		c, _ := NewCluster(append(addrs, dead), 0, 10, WithProtocol(p))
+		stats, err := c.Stats(context.Background())
+		if me, ok := err.(MultiError); !ok || len(me) != 1 || me[dead] == nil {
+			t.Errorf("protocol %d: Stats want error of %s, got %v", p, dead, err)
+		}
+		for _, addr := range addrs {
+			if stats[addr].General().Version != memcachetest.Version {
+				t.Errorf("protocol %d: stats of %s = %v", p, addr, stats[addr])
+			}
+		}
+
+		stats, _ = c.Stats(context.Background(), "settings")
+		if stats[addrs[0]].Settings().MaxBytes == 0 {
+			t.Errorf("protocol %d: settings = %v", p, stats[addrs[0]])
+		}
+
+		// Arguments are not item keys: several of them reach the server,
+		// and an unknown group is reported as such.
+		_, err = c.Stats(context.Background(), "detail", "on")
+		if me, ok := err.(MultiError); !ok || len(me) != 1 || me[dead] == nil {
+			t.Errorf("protocol %d: Stats detail on = %v", p, err)
+		}
+		c.Stats(context.Background(), "detail", "off")
+		_, err = c.Stats(context.Background(), "nosuchgroup")
+		if me, ok := err.(MultiError); !ok || me[addrs[0]] == nil || me[addrs[0]] == ErrCacheMiss {
+			t.Errorf("protocol %d: Stats of an unknown group = %v", p, err)
+		}
+		c.Close()
+	}
+
+	c, _ := New(os.Getenv("MC_ADDRESS"), 0, 10)
+	defer c.Close()
+	if _, err := c.Stats(context.Background(), "slabs"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,219 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// GetTo and SetFrom stream values between the socket and the caller
+// instead of holding them in memory. The connection stays usable once the
+// whole value has been copied. If the copy fails halfway, the value is left
+// unread or unwritten on the socket and the connection is closed.
+
+var errNegativeSize = errors.New("memcache: negative value size")
+
+// GetTo copies the value of the given key to w. The returned item has its
+// flags and CAS set but no value. ErrCacheMiss is returned for a memcache
+// cache miss, in which case nothing is written to w.
+func (c *Conn) GetTo(key string, w io.Writer) (*Item, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	c.rw.WriteString("gets ")
+	c.rw.WriteString(key)
+	if _, err := c.rw.Write(crlf); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := c.rw.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(line, resultEnd) {
+		return nil, ErrCacheMiss
+	}
+	it := new(Item)
+	size, err := scanGetResponseLine(line, it, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(w, c.rw, int64(size)); err != nil {
+		return nil, err
+	}
+
+	var tail [7]byte // "\r\nEND\r\n"
+	if _, err := io.ReadFull(c.rw, tail[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tail[:2], crlf) || !bytes.Equal(tail[2:], resultEnd) {
+		return nil, fmt.Errorf("memcache: corrupt get result read")
+	}
+	return it, nil
+}
+
+// SetFrom writes the size bytes read from r as the value of the given key,
+// unconditionally. r must provide at least size bytes.
+func (c *Conn) SetFrom(key string, r io.Reader, size int64, flags uint32, expiration int32) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	if size < 0 {
+		return errNegativeSize
+	}
+	if _, err := fmt.Fprintf(c.rw, "set %s %d %d %d\r\n", key, flags, expiration, size); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(c.rw, r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if _, err := c.rw.Write(crlf); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	line, err := c.rw.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(line, resultStored):
+		return nil
+	case bytes.Equal(line, resultNotStored):
+		return ErrNotStored
+	}
+	return fmt.Errorf("memcache: unexpected response line from %q: %q", "set", string(line))
+}
+
+// GetTo copies the value of the given key to w. The returned item has its
+// flags and CAS set but no value. ErrCacheMiss is returned for a memcache
+// cache miss, in which case nothing is written to w.
+func (c *BinaryConn) GetTo(key string, w io.Writer) (*Item, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	opaque, err := c.writeRequestHeader(&binaryRequest{opcode: opGet, key: key}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	res, n, err := c.readResponseHeader()
+	if err != nil {
+		return nil, err
+	}
+	if res.opaque != opaque || res.opcode != opGet {
+		return nil, fmt.Errorf("memcache: binary response out of order")
+	}
+	if res.status != statusOK {
+		// The value holds the error message.
+		res.value = make([]byte, n)
+		if _, err := io.ReadFull(c.rw, res.value); err != nil {
+			return nil, err
+		}
+		return nil, res.err()
+	}
+	if len(res.extras) < 4 {
+		return nil, fmt.Errorf("memcache: corrupt get result read")
+	}
+	if _, err := io.CopyN(w, c.rw, int64(n)); err != nil {
+		return nil, err
+	}
+	return &Item{
+		Key:   key,
+		Flags: binary.BigEndian.Uint32(res.extras),
+		CAS:   res.cas,
+	}, nil
+}
+
+// SetFrom writes the size bytes read from r as the value of the given key,
+// unconditionally. r must provide at least size bytes.
+func (c *BinaryConn) SetFrom(key string, r io.Reader, size int64, flags uint32, expiration int32) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	if size < 0 {
+		return errNegativeSize
+	}
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], flags)
+	binary.BigEndian.PutUint32(extras[4:8], uint32(expiration))
+	if size > math.MaxInt32-int64(len(extras)+len(key)) {
+		return fmt.Errorf("memcache: value of %d bytes is too large", size)
+	}
+
+	req := &binaryRequest{opcode: opSet, key: key, extras: extras}
+	opaque, err := c.writeRequestHeader(req, int(size))
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(c.rw, r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	res, err := c.readResponse()
+	if err != nil {
+		return err
+	}
+	if res.opaque != opaque || res.opcode != opSet {
+		return fmt.Errorf("memcache: binary response out of order")
+	}
+	return res.err()
+}
+
+// GetTo copies the value of the given key to w without buffering it, e.g.
+// to send a large cached fragment straight to an HTTP response. The
+// returned item has its flags and CAS set but no value. If writing to w
+// fails, the error is returned and the connection is closed, as the rest of
+// the value cannot be skipped. The value is read from a pooled connection
+// even if the commands are multiplexed, so that a slow or failing w holds
+// up no other command.
+func (c *Client) GetTo(ctx context.Context, key string, w io.Writer) (i *Item, err error) {
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.doPooled(ctx, addr, func(c conn) error {
+		i, err = c.GetTo(key, w)
+		return err
+	})
+
+	return
+}
+
+// SetFrom sets the value of the given key to the size bytes read from r,
+// without buffering them. If r ends early or fails, the error is returned,
+// nothing is stored and the connection is closed. The value is sent over a
+// pooled connection even if the commands are multiplexed, as the shared
+// connection would hold it in memory until the turn of the command.
+func (c *Client) SetFrom(ctx context.Context, key string, r io.Reader, size int64, flags uint32, expiration int32) error {
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+
+	return c.doPooled(ctx, addr, func(c conn) error {
+		return c.SetFrom(key, r, size, flags, expiration)
+	})
+}
@@ -0,0 +1,83 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/go-kiss/memcache/memcachetest"
+)
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n < len(p) {
+		n := w.n
+		w.n = 0
+		return n, errors.New("write failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestClientStream(t *testing.T) {
+	s := memcachetest.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	value := bytes.Repeat([]byte("0123456789abcdef"), 32<<10) // 512 KB
+	for _, proto := range []Protocol{ProtocolText, ProtocolBinary} {
+		c, _ := New(s.Addr(), 0, 10, WithProtocol(proto))
+
+		if err := c.SetFrom(ctx, "stream", bytes.NewReader(value), int64(len(value)), 42, 0); err != nil {
+			t.Fatalf("protocol %d: SetFrom: %v", proto, err)
+		}
+		var buf bytes.Buffer
+		it, err := c.GetTo(ctx, "stream", &buf)
+		if err != nil {
+			t.Fatalf("protocol %d: GetTo: %v", proto, err)
+		}
+		if it.Key != "stream" || it.Flags != 42 || it.CAS == 0 || it.Value != nil {
+			t.Errorf("protocol %d: GetTo item = %+v", proto, it)
+		}
+		if !bytes.Equal(buf.Bytes(), value) {
+			t.Errorf("protocol %d: GetTo copied %d bytes, want the %d set", proto, buf.Len(), len(value))
+		}
+		if st := c.PoolStats(); st.TotalConns != 1 || st.IdleConns != 1 {
+			t.Errorf("protocol %d: connection not returned to the pool: %+v", proto, st)
+		}
+
+		buf.Reset()
+		if _, err := c.GetTo(ctx, "stream-missing", &buf); err != ErrCacheMiss || buf.Len() != 0 {
+			t.Errorf("protocol %d: GetTo of a missing key = %v, %d bytes", proto, err, buf.Len())
+		}
+
+		// A short reader stores nothing and closes the connection.
+		err = c.SetFrom(ctx, "stream-short", io.LimitReader(bytes.NewReader(value), 100), 200, 0, 0)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("protocol %d: SetFrom of a short reader = %v", proto, err)
+		}
+		if st := c.PoolStats(); st.TotalConns != 0 {
+			t.Errorf("protocol %d: broken connection kept: %+v", proto, st)
+		}
+		if _, err := c.Get(ctx, "stream-short"); err != ErrCacheMiss {
+			t.Errorf("protocol %d: Get after a short SetFrom = %v", proto, err)
+		}
+
+		// A failing writer leaves the value unread, the connection is
+		// closed and the next command gets a fresh one.
+		if _, err := c.GetTo(ctx, "stream", &failingWriter{n: 1000}); err == nil {
+			t.Errorf("protocol %d: GetTo of a failing writer succeeded", proto)
+		}
+		if st := c.PoolStats(); st.TotalConns != 0 {
+			t.Errorf("protocol %d: broken connection kept: %+v", proto, st)
+		}
+		if it, err := c.Get(ctx, "stream"); err != nil || !bytes.Equal(it.Value, value) {
+			t.Errorf("protocol %d: Get after a failed GetTo = %v", proto, err)
+		}
+
+		c.Close()
+	}
+}
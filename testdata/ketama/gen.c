@@ -0,0 +1,37 @@
+/*
+ * gen writes the servers libmemcached picks with the weighted ketama
+ * continuum for the keys of TestKetamaSelectorLibmemcached:
+ *
+ *	cc -o gen gen.c -lmemcached && ./gen > libmemcached.txt
+ */
+#include <libmemcached/memcached.h>
+#include <stdio.h>
+#include <string.h>
+
+int main(void)
+{
+	memcached_st *mc = memcached_create(NULL);
+	char key[32];
+	int i;
+
+	memcached_behavior_set(mc, MEMCACHED_BEHAVIOR_KETAMA_WEIGHTED, 1);
+	memcached_server_add(mc, "10.0.1.1", 11211);
+	memcached_server_add(mc, "10.0.1.2", 11211);
+	memcached_server_add(mc, "10.0.1.3", 11212);
+
+	for (i = 0; i < 1000; i++) {
+		memcached_return_t rc;
+		const memcached_instance_st *s;
+
+		snprintf(key, sizeof key, "key%d", i);
+		s = memcached_server_by_key(mc, key, strlen(key), &rc);
+		if (s == NULL) {
+			fprintf(stderr, "%s: %s\n", key, memcached_strerror(mc, rc));
+			return 1;
+		}
+		printf("%s %s:%u\n", key, memcached_server_name(s), (unsigned)memcached_server_port(s));
+	}
+
+	memcached_free(mc);
+	return 0;
+}